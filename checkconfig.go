@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// isCatchAll returns true if the rule matches every message
+func (r *RuleConf) isCatchAll() bool {
+	if len(r.Matchers) == 0 {
+		return false
+	}
+	for _, m := range r.Matchers {
+		if m.String() != "*" {
+			return false
+		}
+	}
+	return true
+}
+
+// lintRules looks for rules which are valid, but almost certainly not what
+// was intended: rules which can never match, and incomplete credentials.
+// Continue rules don't hide the rules after them, since matching goes on.
+func lintRules(rlist []*RuleConf) []error {
+	var errs []error
+	var catchAll = -1
+	var seen = make(map[string]int)
+
+	for i, r := range rlist {
+		switch {
+		case len(r.Matchers) == 0:
+			errs = append(errs, r.errorf("", "rule %d has no matchers, so it can never match", i))
+		case catchAll >= 0:
+			errs = append(errs, r.errorf("", "rule %d can never match: rule %d (%s) is a catch-all",
+				i, catchAll, rlist[catchAll].location()))
+		}
+		if catchAll < 0 && !r.Continue && r.isCatchAll() {
+			catchAll = i
+		}
+
+		if len(r.Matchers) > 0 {
+			var sorted = make([]string, len(r.Matchers))
+			for i, m := range r.Matchers {
+				sorted[i] = m.String()
+			}
+			sort.Strings(sorted)
+			var key = strings.Join(sorted, "\x00")
+			var dupe, isDupe = seen[key]
+			switch {
+			case isDupe:
+				errs = append(errs, r.errorf("", "rule %d can never match: it has the same matchers as rule %d (%s)",
+					i, dupe, rlist[dupe].location()))
+			case !r.Continue:
+				seen[key] = i
+			}
+		}
+
+		for _, a := range r.Auth {
+			var hasSecret = a.passwordSources() > 0 || a.TokenFile != "" || a.TokenCommand != ""
+			if a.Username != "" && !hasSecret && a.Mechanism != "none" {
+				errs = append(errs, r.errorf("username:", "server %q has a username but no password or token", a.Server))
+			}
+			if a.Username == "" && a.passwordSources() > 0 {
+				errs = append(errs, r.errorf("password:", "server %q has a password but no username", a.Server))
+			}
+		}
+	}
+
+	return errs
+}
+
+// sortErrors orders config errors by file, in the order the files were
+// loaded, and then by line.  Errors which aren't tied to a file go last, in
+// the order they were found.
+func sortErrors(errs []error, files []string) {
+	var fileOrder = make(map[string]int)
+	for i, f := range files {
+		fileOrder[f] = i
+	}
+
+	var key = func(err error) (int, int) {
+		var ce, ok = err.(*configError)
+		if !ok {
+			return len(files) + 1, 0
+		}
+		var n, found = fileOrder[ce.file]
+		if !found {
+			n = len(files)
+		}
+		return n, ce.line
+	}
+
+	sort.SliceStable(errs, func(i, j int) bool {
+		var fi, li = key(errs[i])
+		var fj, lj = key(errs[j])
+		if fi != fj {
+			return fi < fj
+		}
+		return li < lj
+	})
+}
+
+// checkTransports validates every named transport on its own, so one which
+// no rule uses yet is still checked.  Rules which use a transport get their
+// own merged copy of its settings, so the transport itself isn't changed.
+func (l *configLoader) checkTransports() []error {
+	var names []string
+	for name := range l.transports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for _, name := range names {
+		var t = (&authentication{}).withTransport(l.transports[name])
+		var err error
+		if t.Server == "" {
+			err = errors.New("no server")
+		}
+		if err == nil {
+			err = t.initDialer()
+		}
+		if err == nil {
+			err = t.initAuth()
+		}
+		if err != nil {
+			var e = *l.transportAt[name]
+			e.msg = fmt.Sprintf("transport %q: %s", name, err)
+			errs = append(errs, &e)
+		}
+	}
+	return errs
+}
+
+// findProblems loads the config at fname and returns every problem found in
+// it, sorted by where it was found
+func findProblems(fname string) (*configLoader, []*RuleConf, []error, error) {
+	var l = newConfigLoader(true)
+	var rlist, err = l.loadMain(fname)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Unknown fields are reported, but don't stop the rest of the checks
+	var errs = l.problems
+	errs = append(errs, l.checkTransports()...)
+	errs = append(errs, initRules(rlist, l.transports, l.vars)...)
+	errs = append(errs, lintRules(rlist)...)
+	sortErrors(errs, l.files)
+	return l, rlist, errs, nil
+}
+
+// checkConfig reports every problem in the config file rather than stopping
+// at the first, exiting with a non-zero status if there are any
+func checkConfig() {
+	var fname = configPath()
+	var l, rlist, errs, err = findProblems(fname)
+	if err != nil {
+		fmt.Printf("Unable to read config: %s\n", err)
+		os.Exit(1)
+	}
+
+	for _, err := range errs {
+		fmt.Println(err)
+	}
+
+	switch {
+	case len(errs) > 0:
+		fmt.Printf("%d problem(s) found in %s\n", len(errs), strings.Join(l.files, ", "))
+		os.Exit(1)
+	case len(rlist) == 0:
+		fmt.Printf("%s: no rules configured\n", fname)
+		os.Exit(1)
+	}
+	fmt.Printf("OK: %d rules in %s\n", len(rlist), strings.Join(l.files, ", "))
+}
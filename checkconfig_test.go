@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/uoregon-libraries/gopkg/assert"
+)
+
+// problems loads the config in data as check-config does and returns each
+// problem's message
+func problems(t *testing.T, data string, perm os.FileMode) []string {
+	var dir = mkconfig(t, map[string]string{"c.yml": data})
+	var fname = filepath.Join(dir, "c.yml")
+	os.Chmod(fname, perm)
+	var _, _, errs, err = findProblems(fname)
+	if err != nil {
+		t.Fatalf("Unable to read config: %s", err)
+	}
+	var msgs []string
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return msgs
+}
+
+// hasProblem returns true if one of msgs contains text
+func hasProblem(msgs []string, text string) bool {
+	for _, msg := range msgs {
+		if strings.Contains(msg, text) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLintRules(t *testing.T) {
+	var auth = "  auth: {server: \"a:25\", mechanism: none}\n"
+	var data = "" +
+		"- matchers: [\"To:a@example.com\"]\n" + auth +
+		"- matchers: [\"*\"]\n  continue: true\n  actions: ['AddHeader X-Seen:yes']\n" +
+		"- matchers: [\"From:b@example.com\", \"To:a@example.com\"]\n" + auth +
+		"- matchers: [\"To:a@example.com\", \"From:b@example.com\"]\n" + auth +
+		"- matchers: [\"To:c@example.com\"]\n  auth:\n    server: a:25\n    username: me\n" +
+		"- matchers: [\"To:d@example.com\"]\n  auth:\n    server: a:25\n    password_env: PW\n" +
+		"- matchers: [\"*\"]\n" + auth +
+		"- matchers: [\"To:e@example.com\"]\n" + auth
+
+	var msgs = problems(t, data, 0600)
+	assert.Equal(4, len(msgs), "problems found: "+strings.Join(msgs, "; "), t)
+	assert.True(hasProblem(msgs, "line 8: rule 3 can never match: it has the same matchers as rule 2"),
+		"duplicate matchers in any order", t)
+	assert.True(hasProblem(msgs, "line 13: server \"a:25\" has a username but no password or token"),
+		"missing password", t)
+	assert.True(hasProblem(msgs, "line 14: server \"a:25\" has a password but no username"),
+		"missing username", t)
+	assert.True(hasProblem(msgs, "line 20: rule 7 can never match: rule 6"), "rule after a catch-all", t)
+	assert.False(hasProblem(msgs, "rule 1 ("), "a continue catch-all hides nothing", t)
+
+	msgs = problems(t, "- matchers: []\n", 0600)
+	assert.True(hasProblem(msgs, "rule 0 has no matchers"), "rule without matchers", t)
+}
+
+func TestFindProblemsTransports(t *testing.T) {
+	var data = "" +
+		"transports:\n" +
+		"  unused:\n    server: a:25\n    tls: sometimes\n" +
+		"  noserver:\n    username: me\n    password_env: PW\n" +
+		"  inline:\n    server: a:25\n    username: me\n    password: secret\n" +
+		"rules:\n" +
+		"  - matchers: [\"*\"]\n    transport: inline\n"
+
+	var msgs = problems(t, data, 0644)
+	assert.Equal(3, len(msgs), "problems found: "+strings.Join(msgs, "; "), t)
+	assert.True(strings.Contains(msgs[0], "line 2: transport \"unused\""), "unused transport is checked: "+msgs[0], t)
+	assert.True(strings.Contains(msgs[1], "line 5: transport \"noserver\": no server"), "transport without a server: "+msgs[1], t)
+	assert.True(strings.Contains(msgs[2], "line 8:"), "inline password is one more problem: "+msgs[2], t)
+}
+
+func TestSortErrors(t *testing.T) {
+	var other = errors.New("other")
+	var errs = []error{
+		other,
+		&configError{file: "b.yml", line: 1, msg: "b1"},
+		&configError{file: "unknown.yml", line: 1, msg: "u1"},
+		&configError{file: "a.yml", line: 9, msg: "a9"},
+		&configError{file: "b.yml", line: 0, msg: "b0"},
+		&configError{file: "a.yml", line: 2, msg: "a2"},
+	}
+	sortErrors(errs, []string{"a.yml", "b.yml"})
+
+	var msgs []string
+	for _, err := range errs {
+		if ce, ok := err.(*configError); ok {
+			msgs = append(msgs, ce.msg)
+		} else {
+			msgs = append(msgs, err.Error())
+		}
+	}
+	assert.Equal("a2,a9,b0,b1,u1,other", strings.Join(msgs, ","), "errors by file load order, then line", t)
+}
+
+func TestRuleStarts(t *testing.T) {
+	var tests = map[string]struct {
+		data   string
+		starts string
+		end    int
+	}{
+		"old format": {
+			data:   "# rules\n- matchers: [\"*\"]\n  actions:\n    - Discard\n\n- matchers: [\"*\"]\n",
+			starts: "2,6",
+			end:    8,
+		},
+		"structured": {
+			data:   "vars:\n  a: b\nrules:\n  - matchers: [\"*\"]\n    actions:\n      - Discard\n  - matchers: [\"*\"]\ntransports:\n  t:\n    server: a:25\n",
+			starts: "4,7",
+			end:    8,
+		},
+		"no rules": {
+			data:   "vars:\n  a: b\n",
+			starts: "",
+			end:    4,
+		},
+	}
+
+	for name, tc := range tests {
+		var starts, end = newConfigSource("c.yml", []byte(tc.data)).ruleStarts()
+		var got []string
+		for _, n := range starts {
+			got = append(got, strconv.Itoa(n))
+		}
+		assert.Equal(tc.starts, strings.Join(got, ","), name+": rule starts", t)
+		assert.Equal(tc.end, end, name+": end", t)
+	}
+}
+
+func TestFind(t *testing.T) {
+	var src = newConfigSource("c.yml", []byte("a\nb: 1\nc\nb: 2\n"))
+	assert.Equal(2, src.find("b:", 1, 5), "first match", t)
+	assert.Equal(4, src.find("b:", 3, 5), "match from start", t)
+	assert.Equal(3, src.find("b:", 3, 4), "end isn't searched", t)
+	assert.Equal(1, src.find("z", 1, 5), "not found returns start", t)
+	assert.Equal(3, src.find("", 3, 5), "empty text returns start", t)
+	assert.Equal(0, src.find("b:", 0, 5), "no start line", t)
+	assert.Equal(4, src.find("b: 2", 1, 100), "end past the last line", t)
+}
+
+func TestUnquotedNegation(t *testing.T) {
+	var data = "- matchers:\n    - \"To:a@example.com\"\n    - !X-Test:yes\n  auth: {server: \"a:25\", mechanism: none}\n"
+
+	var msgs = problems(t, data, 0600)
+	assert.True(hasProblem(msgs, `line 3: empty rule matcher: a matcher starting with "!" must be quoted`),
+		"unquoted negation: "+strings.Join(msgs, "; "), t)
+}
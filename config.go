@@ -0,0 +1,462 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-yaml/yaml"
+)
+
+// configError is a problem found in a config file.  line is zero when the
+// problem can't be tied to a specific line.
+//
+// The YAML parser doesn't report where values were found, so lines are worked
+// out by searching the file's text (see configSource).  That's right for the
+// usual block-style config, but can be off for flow-style YAML or keys which
+// appear more than once, so lines are always reported as approximate.
+type configError struct {
+	file string
+	line int
+	msg  string
+}
+
+func (e *configError) Error() string {
+	if e.line > 0 {
+		return fmt.Sprintf("%s: near line %d: %s", e.file, e.line, e.msg)
+	}
+	return fmt.Sprintf("%s: %s", e.file, e.msg)
+}
+
+// configSource holds a config file's name and raw lines so problems found
+// after the YAML has been parsed can still be reported with line numbers
+type configSource struct {
+	file  string
+	lines []string
+}
+
+func newConfigSource(file string, data []byte) *configSource {
+	return &configSource{file: file, lines: strings.Split(string(data), "\n")}
+}
+
+// ruleStarts returns the line number of each rule's list item, and the line
+// just past the last rule.  Rules are the top-level list in the old config
+// format, or the list under "rules:" in the structured one.
+func (src *configSource) ruleStarts() (starts []int, end int) {
+	var first = 0
+	for i, l := range src.lines {
+		if strings.HasPrefix(l, "rules:") {
+			first = i + 1
+			break
+		}
+	}
+
+	var indent = -1
+	end = len(src.lines) + 1
+	for i := first; i < len(src.lines); i++ {
+		var l = src.lines[i]
+		var trimmed = strings.TrimLeft(l, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		// In the structured format, the next top-level key ends the rules
+		if first > 0 && l == trimmed && trimmed[0] != '-' {
+			end = i + 1
+			break
+		}
+
+		var isItem = trimmed == "-" || strings.HasPrefix(trimmed, "- ")
+		if isItem && indent < 0 && (first > 0 || l == trimmed) {
+			indent = len(l) - len(trimmed)
+		}
+		if isItem && len(l)-len(trimmed) == indent {
+			starts = append(starts, i+1)
+		}
+	}
+	return starts, end
+}
+
+// find returns the number of the first line from start up to (but not
+// including) end which contains text.  If text is empty or isn't found, start
+// is returned.
+func (src *configSource) find(text string, start, end int) int {
+	if text == "" || start < 1 {
+		return start
+	}
+	for n := start; n < end && n <= len(src.lines); n++ {
+		if strings.Contains(src.lines[n-1], text) {
+			return n
+		}
+	}
+	return start
+}
+
+// location returns the rule's file and approximate line for messages
+func (r *RuleConf) location() string {
+	if r.src == nil {
+		return "unknown location"
+	}
+	return fmt.Sprintf("%s near line %d", r.src.file, r.line)
+}
+
+// errorf returns a configError for the rule, using the line where near
+// appears in the rule's YAML if possible, otherwise the rule's first line
+func (r *RuleConf) errorf(near string, format string, args ...interface{}) error {
+	var e = &configError{msg: fmt.Sprintf(format, args...)}
+	if r.src != nil {
+		e.file = r.src.file
+		e.line = r.src.find(near, r.line, r.endLine)
+	}
+	return e
+}
+
+// configPath returns the config file or directory to use: the -C flag or
+// GO_SENDMAIL_CONFIG if either is set, otherwise "/etc/go-sendmail.yml".
+// The current directory is never searched, since whoever runs sendmail
+// shouldn't be able to choose its rules (and credentials) by where they run it.
+func configPath() string {
+	if opts.Config != "" {
+		return opts.Config
+	}
+	return "/etc/go-sendmail.yml"
+}
+
+// confDir returns the drop-in directory for a config file: the file's path
+// with its extension replaced by ".d", e.g., "/etc/go-sendmail.d" for
+// "/etc/go-sendmail.yml"
+func confDir(fname string) string {
+	return strings.TrimSuffix(fname, filepath.Ext(fname)) + ".d"
+}
+
+// isConfigFile returns true if the name looks like a YAML file
+func isConfigFile(name string) bool {
+	var ext = filepath.Ext(name)
+	return ext == ".yml" || ext == ".yaml"
+}
+
+// configDoc is the structured config format, with named transports and the
+// rules which use them.  A file may instead be just the list of rules.
+type configDoc struct {
+	Transports map[string]*authentication
+	Rules      []*RuleConf
+
+	// Vars are made available to action templates as {{.Vars.name}}
+	Vars map[string]string
+
+	// SplitRecipients turns on split delivery: see deliverSplit
+	SplitRecipients bool `yaml:"split_recipients"`
+}
+
+// splitRecipients is set when any config file turns on split delivery
+var splitRecipients bool
+
+// configLoader reads config files, following include directives
+type configLoader struct {
+	// strict makes the loader report unknown fields in problems.  The config
+	// is still loaded as if it weren't strict, so other checks can run.
+	strict   bool
+	problems []error
+
+	// files lists every file read, in order
+	files []string
+
+	// loaded holds the absolute path of every file read, to catch include
+	// cycles and files which would otherwise have their rules added twice
+	loaded map[string]bool
+
+	// transports holds the named transports from every file read, and
+	// transportAt where each was defined
+	transports  map[string]*authentication
+	transportAt map[string]*configError
+
+	// vars holds the template variables from every file read
+	vars map[string]string
+
+	// split is true if any file read turns on split delivery
+	split bool
+}
+
+func newConfigLoader(strict bool) *configLoader {
+	return &configLoader{
+		strict:      strict,
+		loaded:      make(map[string]bool),
+		transports:  make(map[string]*authentication),
+		transportAt: make(map[string]*configError),
+		vars:        make(map[string]string),
+	}
+}
+
+// loadMain reads the top-level config, which may be a file or a directory.
+// A file's drop-in directory is read afterward if it exists.
+func (l *configLoader) loadMain(path string) ([]*RuleConf, error) {
+	var rlist, err = l.load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var info os.FileInfo
+	info, err = os.Stat(path)
+	if err != nil || info.IsDir() {
+		return rlist, err
+	}
+
+	var dir = confDir(path)
+	info, err = os.Stat(dir)
+	if err != nil || !info.IsDir() {
+		return rlist, nil
+	}
+
+	var more []*RuleConf
+	more, err = l.loadDir(dir)
+	return append(rlist, more...), err
+}
+
+// load reads a config file, or all config files in a directory
+func (l *configLoader) load(path string) ([]*RuleConf, error) {
+	var info, err = os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return l.loadDir(path)
+	}
+	return l.loadFile(path)
+}
+
+// loadDir reads every YAML file in dir in lexical order
+func (l *configLoader) loadDir(dir string) ([]*RuleConf, error) {
+	var infos, err = ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var rlist []*RuleConf
+	for _, info := range infos {
+		if info.IsDir() || !isConfigFile(info.Name()) {
+			continue
+		}
+		var more []*RuleConf
+		more, err = l.loadFile(filepath.Join(dir, info.Name()))
+		if err != nil {
+			return nil, err
+		}
+		rlist = append(rlist, more...)
+	}
+	return rlist, nil
+}
+
+// loadFile reads a single config file, replacing its include directives with
+// the rules from the included files
+func (l *configLoader) loadFile(fname string) ([]*RuleConf, error) {
+	var abs, err = filepath.Abs(fname)
+	if err != nil {
+		return nil, err
+	}
+	if l.loaded[abs] {
+		return nil, fmt.Errorf("%s is included more than once", fname)
+	}
+	l.loaded[abs] = true
+
+	var data []byte
+	data, err = ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	l.files = append(l.files, fname)
+
+	var doc *configDoc
+	if l.strict {
+		doc, err = parseConfig(fname, data, true)
+		if err != nil {
+			l.problems = append(l.problems, err)
+		}
+	}
+	if doc == nil {
+		doc, err = parseConfig(fname, data, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// check-config reports an inline password in a world-readable file along
+	// with everything else, but it keeps the config from being used
+	var src = newConfigSource(fname, data)
+	err = checkInlinePasswords(src, doc)
+	if err != nil && !l.strict {
+		return nil, err
+	}
+	if err != nil {
+		l.problems = append(l.problems, err)
+	}
+
+	for name, t := range doc.Transports {
+		var line = src.find(name+":", 1, len(src.lines)+1)
+		if l.transports[name] != nil {
+			return nil, &configError{file: fname, line: line, msg: fmt.Sprintf("transport %q is defined more than once", name)}
+		}
+		if t == nil || t.Transport != "" {
+			return nil, &configError{file: fname, line: line, msg: fmt.Sprintf("transport %q must be a single auth block which doesn't name another transport", name)}
+		}
+		t.Mechanism = strings.ToLower(t.Mechanism)
+		l.transports[name] = t
+		l.transportAt[name] = &configError{file: fname, line: line}
+	}
+
+	for name, val := range doc.Vars {
+		var _, dupe = l.vars[name]
+		if dupe {
+			var line = src.find(name+":", 1, len(src.lines)+1)
+			return nil, &configError{file: fname, line: line, msg: fmt.Sprintf("var %q is defined more than once", name)}
+		}
+		l.vars[name] = val
+	}
+
+	l.split = l.split || doc.SplitRecipients
+
+	var out []*RuleConf
+	for _, r := range doc.Rules {
+		if r.Include == "" {
+			for _, a := range r.Auth {
+				a.Mechanism = strings.ToLower(a.Mechanism)
+			}
+			out = append(out, r)
+			continue
+		}
+
+		if len(r.Matchers) > 0 || len(r.Actions) > 0 || len(r.Auth) > 0 || r.Transport != "" || r.Continue || r.Name != "" {
+			return nil, r.errorf("include", "include entries can't have any other settings")
+		}
+		var more []*RuleConf
+		more, err = l.include(fname, r.Include)
+		if err != nil {
+			return nil, r.errorf("include", "unable to include %q: %s", r.Include, err)
+		}
+		out = append(out, more...)
+	}
+
+	return out, nil
+}
+
+// checkInlinePasswords returns an error if any rule or transport in the file
+// has a password written directly in it and anybody on the system can read
+// the file
+func checkInlinePasswords(src *configSource, doc *configDoc) error {
+	var info, err = os.Stat(src.file)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm()&0004 == 0 {
+		return nil
+	}
+
+	var msg = fmt.Sprintf("refusing to use an inline password from a world-readable file "+
+		"(run \"chmod o-r %s\" or use password_file, password_env, or password_command)", src.file)
+	for name, t := range doc.Transports {
+		if t != nil && t.Password != "" {
+			var line = src.find(name+":", 1, len(src.lines)+1)
+			return &configError{file: src.file, line: line, msg: fmt.Sprintf("transport %q: %s", name, msg)}
+		}
+	}
+	for _, r := range doc.Rules {
+		for _, a := range r.Auth {
+			if a.Password != "" {
+				return r.errorf("password:", "%s", msg)
+			}
+		}
+	}
+	return nil
+}
+
+// include reads the file, directory, or glob pattern named in an include
+// directive.  Relative paths are relative to the including file's directory.
+func (l *configLoader) include(fname, pattern string) ([]*RuleConf, error) {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(fname), pattern)
+	}
+
+	var paths, err = filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 && !strings.ContainsAny(pattern, "*?[") {
+		return nil, fmt.Errorf("%s does not exist", pattern)
+	}
+
+	var rlist []*RuleConf
+	for _, path := range paths {
+		var more []*RuleConf
+		more, err = l.load(path)
+		if err != nil {
+			return nil, err
+		}
+		rlist = append(rlist, more...)
+	}
+	return rlist, nil
+}
+
+// parseConfig unmarshals the config in data, which may be a structured
+// document or just a list of rules, noting where each rule starts and ends in
+// the file.  If strict is true, unknown fields are errors.
+func parseConfig(fname string, data []byte, strict bool) (*configDoc, error) {
+	var unmarshal = yaml.Unmarshal
+	if strict {
+		unmarshal = yaml.UnmarshalStrict
+	}
+
+	var raw interface{}
+	var err = yaml.Unmarshal(data, &raw)
+	var doc = new(configDoc)
+	if err == nil {
+		if _, isList := raw.([]interface{}); isList {
+			err = unmarshal(data, &doc.Rules)
+		} else {
+			err = unmarshal(data, doc)
+		}
+	}
+	if err != nil {
+		return nil, &configError{file: fname, msg: err.Error()}
+	}
+
+	var src = newConfigSource(fname, data)
+	var starts, end = src.ruleStarts()
+	for i, r := range doc.Rules {
+		r.src = src
+		if len(starts) != len(doc.Rules) {
+			continue
+		}
+		r.line = starts[i]
+		r.endLine = end
+		if i+1 < len(starts) {
+			r.endLine = starts[i+1]
+		}
+	}
+
+	return doc, nil
+}
+
+func readRules() []*RuleConf {
+	var path = configPath()
+	if opts.Verbose {
+		log.Printf("DEBUG: Reading config from %q", path)
+	}
+
+	var l = newConfigLoader(false)
+	var rlist, err = l.loadMain(path)
+	if err != nil {
+		log.Fatalf("Unable to read config: %s", err)
+	}
+
+	var errs = initRules(rlist, l.transports, l.vars)
+	if len(errs) > 0 {
+		for _, err := range errs {
+			log.Print(err)
+		}
+		log.Fatalf("Invalid configuration in %q", path)
+	}
+	splitRecipients = l.split
+	return rlist
+}
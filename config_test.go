@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Nerdmaster/sendmail/email"
+	"github.com/uoregon-libraries/gopkg/assert"
+)
+
+// mkconfig writes files (name to contents) into a new temp dir and returns
+// the dir's path.  Names ending in "/" are created as directories.
+func mkconfig(t *testing.T, files map[string]string) string {
+	var dir, err = ioutil.TempDir("", "go-sendmail-config-")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	for name, data := range files {
+		var path = filepath.Join(dir, name)
+		if strings.HasSuffix(name, "/") {
+			err = os.MkdirAll(path, 0700)
+		} else {
+			err = os.MkdirAll(filepath.Dir(path), 0700)
+			if err == nil {
+				err = ioutil.WriteFile(path, []byte(data), 0600)
+			}
+		}
+		if err != nil {
+			t.Fatalf("Unable to write %s: %s", name, err)
+		}
+	}
+	return dir
+}
+
+// mkrules loads and initializes the rules in data, failing the test if
+// they're invalid
+func mkrules(t *testing.T, data string) []*RuleConf {
+	var dir = mkconfig(t, map[string]string{"c.yml": data})
+	var l = newConfigLoader(false)
+	var rules, err = l.loadMain(filepath.Join(dir, "c.yml"))
+	if err != nil {
+		t.Fatalf("Unable to load rules: %s", err)
+	}
+	var errs = initRules(rules, l.transports, l.vars)
+	if len(errs) > 0 {
+		t.Fatalf("Invalid rules: %s", errs)
+	}
+	return rules
+}
+
+// mkemail returns a short message from me@example.com.  to is written
+// directly after "To: ", so it can add more header lines.
+func mkemail(t *testing.T, to string) *email.Email {
+	var e, err = email.Read(strings.NewReader("From: me@example.com\nTo: " + to + "\nSubject: hi\n\nhi"))
+	if err != nil {
+		t.Fatalf("Couldn't read email: %s", err)
+	}
+	return e
+}
+
+// namedRule returns a one-rule list in the old config format
+func namedRule(name string) string {
+	return "- name: " + name + "\n  matchers: [\"*\"]\n"
+}
+
+func ruleNames(rlist []*RuleConf) string {
+	var names []string
+	for _, r := range rlist {
+		names = append(names, r.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestLoadDir(t *testing.T) {
+	var dir = mkconfig(t, map[string]string{
+		"20-b.yml":     namedRule("b"),
+		"10-a.yml":     namedRule("a"),
+		"30-c.yaml":    namedRule("c"),
+		"README":       "not config",
+		"40-d.yml.bak": namedRule("d"),
+		"sub/":         "",
+	})
+
+	var l = newConfigLoader(false)
+	var rlist, err = l.loadMain(dir)
+	assert.NilError(err, "loading directory", t)
+	assert.Equal("a,b,c", ruleNames(rlist), "YAML files are read in lexical order", t)
+	assert.Equal(3, len(l.files), "files read", t)
+}
+
+func TestLoadMainDropIn(t *testing.T) {
+	var dir = mkconfig(t, map[string]string{
+		"main.yml":      "vars:\n  site: www\nrules:\n" + "  - name: main\n    matchers: [\"*\"]\n",
+		"main.d/b.yml":  namedRule("drop-b"),
+		"main.d/a.yml":  "vars:\n  env: prod\nsplit_recipients: true\n",
+		"other.d/x.yml": namedRule("other"),
+	})
+
+	var l = newConfigLoader(false)
+	var rlist, err = l.loadMain(filepath.Join(dir, "main.yml"))
+	assert.NilError(err, "loading config", t)
+	assert.Equal("main,drop-b", ruleNames(rlist), "drop-in rules follow the main file's", t)
+	assert.Equal("www", l.vars["site"], "main file's vars", t)
+	assert.Equal("prod", l.vars["env"], "drop-in vars", t)
+	assert.True(l.split, "split delivery set by a drop-in", t)
+}
+
+func TestInclude(t *testing.T) {
+	var dir = mkconfig(t, map[string]string{
+		"main.yml":      namedRule("first") + "- include: rules/*.yml\n" + namedRule("last"),
+		"rules/b.yml":   namedRule("b"),
+		"rules/a.yml":   namedRule("a") + "- include: ../more\n",
+		"more/one.yml":  namedRule("one"),
+		"rules/c.yml.x": namedRule("skipped"),
+	})
+
+	var l = newConfigLoader(false)
+	var rlist, err = l.loadMain(filepath.Join(dir, "main.yml"))
+	assert.NilError(err, "loading config", t)
+	assert.Equal("first,a,one,b,last", ruleNames(rlist), "included rules replace the include entry", t)
+
+	dir = mkconfig(t, map[string]string{"main.yml": "- include: nope.yml\n"})
+	l = newConfigLoader(false)
+	_, err = l.loadMain(filepath.Join(dir, "main.yml"))
+	assert.True(err != nil && strings.Contains(err.Error(), "does not exist"), "missing include is an error", t)
+}
+
+func TestIncludeCycle(t *testing.T) {
+	var dir = mkconfig(t, map[string]string{
+		"main.yml": namedRule("main") + "- include: a.yml\n",
+		"a.yml":    namedRule("a") + "- include: b.yml\n",
+		"b.yml":    namedRule("b") + "- include: a.yml\n",
+	})
+
+	var l = newConfigLoader(false)
+	var _, err = l.loadMain(filepath.Join(dir, "main.yml"))
+	assert.True(err != nil, "include cycle is an error", t)
+	assert.True(strings.Contains(err.Error(), "included more than once"), "cycle error: "+err.Error(), t)
+
+	dir = mkconfig(t, map[string]string{
+		"main.yml": namedRule("main") + "- include: main.yml\n",
+	})
+	l = newConfigLoader(false)
+	_, err = l.loadMain(filepath.Join(dir, "main.yml"))
+	assert.True(err != nil, "including itself is an error", t)
+}
+
+func TestCheckInlinePasswords(t *testing.T) {
+	var check = func(data string, perm os.FileMode) error {
+		var dir = mkconfig(t, map[string]string{"c.yml": data})
+		var fname = filepath.Join(dir, "c.yml")
+		os.Chmod(fname, perm)
+		var doc, err = parseConfig(fname, []byte(data), false)
+		if err != nil {
+			t.Fatalf("Unable to parse config: %s", err)
+		}
+		return checkInlinePasswords(newConfigSource(fname, []byte(data)), doc)
+	}
+
+	var transport = "transports:\n  t:\n    server: a:25\n    username: me\n    password: secret\n"
+	var ruleAuth = "- matchers: [\"*\"]\n  auth:\n    server: a:25\n    username: me\n    password: secret\n"
+	var pwFile = "- matchers: [\"*\"]\n  auth:\n    server: a:25\n    username: me\n    password_file: /etc/pw\n"
+
+	var err = check(transport, 0644)
+	assert.True(err != nil, "inline transport password in a world-readable file", t)
+	var ce, _ = err.(*configError)
+	assert.True(ce != nil && ce.line == 2, "error points at the transport: "+err.Error(), t)
+	assert.True(check(ruleAuth, 0604) != nil, "inline rule password in a world-readable file", t)
+	assert.NilError(check(transport, 0640), "inline password in a file only the group can read", t)
+	assert.NilError(check(ruleAuth, 0600), "inline password in a private file", t)
+	assert.NilError(check(pwFile, 0644), "password_file in a world-readable file", t)
+}
+
+func TestStructuredConfig(t *testing.T) {
+	var data = `# comment
+vars:
+  site: www.example.com
+split_recipients: true
+transports:
+  relay:
+    server: relay.example.com:587
+    username: relay
+    password_env: SENDMAIL_TEST_RELAY_PASSWORD
+    insecure_skip_verify: true
+rules:
+  - name: first
+    matchers: ["To:a@example.com"]
+    transport: relay
+  - name: second
+    matchers: ["*"]
+    transport: relay
+    auth:
+      insecure_skip_verify: false
+`
+	var dir = mkconfig(t, map[string]string{"c.yml": data})
+	var l = newConfigLoader(true)
+	var rlist, err = l.loadMain(filepath.Join(dir, "c.yml"))
+	assert.NilError(err, "loading config", t)
+	assert.Equal(0, len(l.problems), "no unknown fields", t)
+	assert.Equal("first,second", ruleNames(rlist), "rules", t)
+	assert.Equal(12, rlist[0].line, "first rule's line", t)
+	assert.Equal(15, rlist[1].line, "second rule's line", t)
+	assert.Equal("www.example.com", l.vars["site"], "vars", t)
+	assert.True(l.split, "split_recipients", t)
+	assert.Equal("relay.example.com:587", l.transports["relay"].Server, "transport", t)
+
+	var errs = initRules(rlist, l.transports, l.vars)
+	assert.Equal(0, len(errs), "rules are valid", t)
+	assert.Equal("relay", rlist[0].Auth[0].Username, "transport settings", t)
+	assert.True(rlist[0].Auth[0].dialer.TLSConfig.InsecureSkipVerify, "transport's insecure_skip_verify", t)
+	assert.False(rlist[1].Auth[0].dialer.TLSConfig.InsecureSkipVerify, "rule overrides insecure_skip_verify", t)
+}
+
+func TestMechanismCase(t *testing.T) {
+	var fs = newFakeServer(t)
+	var rules = mkrules(t, fmt.Sprintf("transports:\n  relay: {server: %q, mechanism: NONE, tls: none}\n"+
+		"rules:\n"+
+		"  - matchers: [\"To:a@example.org\"]\n    transport: relay\n"+
+		"  - matchers: [\"*\"]\n    auth: {server: %q, mechanism: None, tls: none, username: me, password_file: /nonexistent}\n",
+		fs.addr, fs.addr))
+	assert.Equal("none", rules[0].Auth[0].Mechanism, "transport's mechanism is lowercased", t)
+	assert.Equal("none", rules[1].Auth[0].Mechanism, "rule's mechanism is lowercased", t)
+
+	assert.NilError(deliver(rules, mkemail(t, "b@example.org")), "no password is looked up for mechanism None", t)
+	assert.Equal(0, len(lintRules(rules)), "a username without a password is fine for mechanism None", t)
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/mail"
@@ -53,29 +54,67 @@ func (h Header) Get(key string) string {
 	return textproto.MIMEHeader(h.h).Get(key)
 }
 
+// Values returns every value for the given header field, in the order they
+// appeared.  A field which isn't present returns nil, while one which is
+// present but empty returns an empty string.
+func (h Header) Values(key string) []string {
+	return textproto.MIMEHeader(h.h).Values(key)
+}
+
 // Set replaces the field identified by key with the single value passed in
 func (h Header) Set(key, value string) {
 	textproto.MIMEHeader(h.h).Set(key, value)
 }
 
+// Add appends a value to the field identified by key, keeping any existing
+// values
+func (h Header) Add(key, value string) {
+	textproto.MIMEHeader(h.h).Add(key, value)
+}
+
 // Del removes the given header
 func (h Header) Del(key string) {
 	textproto.MIMEHeader(h.h).Del(key)
 }
 
-// Write writes a header in wire format, reprinting only the first value of any
-// given field, as the spec states multiple occurrences of the same field have
-// no specific interpretation, and are discouraged.  We deliberately ignore BCC
-// since outgoing emails don't need it.
+// Fields returns the names of every field in the header, sorted
+func (h Header) Fields() []string {
+	var keys = make([]string, 0, len(h.h))
+	for k := range h.h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// singleFields are the fields RFC 5322 allows only once.  Multiple
+// occurrences have no specific interpretation, so only the first is kept.
+var singleFields = map[string]bool{
+	"Date": true, "From": true, "Sender": true, "Reply-To": true, "To": true, "Cc": true, "Bcc": true,
+	"Message-Id": true, "In-Reply-To": true, "References": true, "Subject": true,
+}
+
+// Write writes a header in wire format, sorted by field name.  Fields which
+// may only appear once (From, To, Subject, etc.) are reprinted with only their
+// first value, as the spec states multiple occurrences of those fields have no
+// specific interpretation, and are discouraged.  Other fields, like Received
+// or X-Tag, keep all their values in order.  We deliberately ignore BCC since
+// outgoing emails don't need it.
 func (h Header) Write(w io.Writer) error {
 	var data []string
-	for k, vlist := range h.h {
-		if strings.ToLower(k) == "bcc" {
+	for _, k := range h.Fields() {
+		var ck = textproto.CanonicalMIMEHeaderKey(k)
+		if ck == "Bcc" {
 			continue
 		}
-		data = append(data, k+": "+vlist[0])
+		var vlist = h.h[k]
+		if singleFields[ck] && len(vlist) > 1 {
+			vlist = vlist[:1]
+		}
+		for _, v := range vlist {
+			data = append(data, k+": "+v)
+		}
 	}
-	sort.Strings(data)
 	var _, err = w.Write([]byte(strings.Join(data, "\r\n")))
 	return err
 }
@@ -100,6 +139,28 @@ func (list AddressList) String() string {
 	return strings.Join(list.Strings(), ",")
 }
 
+// Contains returns true if any address in the list has the given email
+// address.  Addresses are compared case-insensitively.
+func (list AddressList) Contains(address string) bool {
+	for _, addr := range list {
+		if strings.EqualFold(addr.Address, address) {
+			return true
+		}
+	}
+	return false
+}
+
+// AppendAddress appends address to list unless it's already there.
+// Addresses are compared case-insensitively, as with Contains.
+func AppendAddress(list []string, address string) []string {
+	for _, a := range list {
+		if strings.EqualFold(a, address) {
+			return list
+		}
+	}
+	return append(list, address)
+}
+
 // Strings returns a single string for each address in the list, suitable for
 // the smtp SendMail call
 func (list AddressList) Strings() []string {
@@ -110,17 +171,52 @@ func (list AddressList) Strings() []string {
 	return s
 }
 
+// Envelope holds the SMTP-level sender and recipients of a message.  These
+// are what the mail server actually uses for delivery and bounces, and need
+// not match the header fields (e.g., a bounce address or Bcc recipients).
+type Envelope struct {
+	From string
+	To   []string
+
+	// NullSender is set when the message was given the null sender ("MAIL
+	// FROM:<>"), as bounces and delivery notifications are, so the empty From
+	// isn't replaced by the header's address
+	NullSender bool
+
+	// NoRecipients is set when every recipient has been removed (e.g., by a
+	// rule's DropRecipient action), so the empty To isn't replaced by the
+	// header's addresses.  A message with no recipients can't be sent.
+	NoRecipients bool
+}
+
 // An Email parses message data to prepare for SMTP delivery
 type Email struct {
-	Message []byte
-	Header  Header
-	Auth    smtp.Auth
-	Mailer  func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+	Message  []byte
+	Header   Header
+	Envelope Envelope
+	Auth     smtp.Auth
+	Mailer   func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+
+	// parsed caches the MIME parts of Message; see Parts
+	parsed *parsedMessage
 }
 
-// New returns a basic Email instance with its Mailer set to the default smtp.SendMail
+// New returns a basic Email instance with its Mailer set to DefaultDialer's
+// SendMail, which behaves the same as smtp.SendMail
 func New() *Email {
-	return &Email{Mailer: smtp.SendMail, Header: Header{h: make(mail.Header)}}
+	return &Email{Mailer: DefaultDialer.SendMail, Header: Header{h: make(mail.Header)}}
+}
+
+// Clone returns a deep copy of the email, so the copy's header, envelope, and
+// message can be changed without affecting the original
+func (e *Email) Clone() *Email {
+	var e2 = *e
+	e2.Header = e.Header.Clone()
+	e2.Message = make([]byte, len(e.Message))
+	copy(e2.Message, e.Message)
+	e2.Envelope.To = append([]string(nil), e.Envelope.To...)
+	e2.parsed = e.parsed.forCopy(e, &e2)
+	return &e2
 }
 
 // Read processes the given reader, treating it as if it were a stdin buffer as
@@ -128,15 +224,24 @@ func New() *Email {
 // fields in the returned Email instance.
 func Read(r io.Reader) (*Email, error) {
 	var e = New()
-	return e, e.read(r)
+	return e, e.read(r, true)
+}
+
+// ReadIgnoringDots works like Read, but a line with a single "." is treated
+// as part of the message rather than the end of input, as sendmail's "-i" and
+// "-oi" flags request.  The stream is read until it ends.
+func ReadIgnoringDots(r io.Reader) (*Email, error) {
+	var e = New()
+	return e, e.read(r, false)
 }
 
-// read actually does the work of parsing data from r
-func (e *Email) read(r io.Reader) error {
+// read actually does the work of parsing data from r.  If dotTerminates is
+// true, a line with only a "." on it ends the message.
+func (e *Email) read(r io.Reader, dotTerminates bool) error {
 	// In order to stop on the first ".", we have to process and then rewrite the
 	// reader, otherwise the mail package just keeps on reading indefinitely.
 	// Not to mention includes that "." in the email body.
-	var newR, err = e.readToDot(r)
+	var newR, err = e.readToDot(r, dotTerminates)
 	if err != nil {
 		return err
 	}
@@ -157,13 +262,14 @@ func (e *Email) read(r io.Reader) error {
 }
 
 // readToDot reads the raw email data until a single "." is on a line by itself
-// or the stream ends
-func (e *Email) readToDot(r io.Reader) (io.Reader, error) {
+// or the stream ends.  If dotTerminates is false, the "." line is kept as
+// message data and only the end of the stream stops reading.
+func (e *Email) readToDot(r io.Reader, dotTerminates bool) (io.Reader, error) {
 	var s = bufio.NewScanner(r)
 	var lines []string
 	for s.Scan() {
 		var txt = s.Text()
-		if txt == "." {
+		if dotTerminates && txt == "." {
 			break
 		}
 		lines = append(lines, s.Text())
@@ -176,41 +282,72 @@ func (e *Email) readToDot(r io.Reader) (io.Reader, error) {
 	return strings.NewReader(strings.Join(lines, "\r\n")), s.Err()
 }
 
-// Send uses the header data, Auth, and the given host to attempt to send the
-// message via smtp
-func (e *Email) Send(host string) error {
-	var err error
-	var from *mail.Address
-	var to, cc, bcc AddressList
+// Sender returns the envelope sender if one is set, otherwise the address in
+// the "from" header field.  A null sender is returned as an empty string.
+func (e *Email) Sender() (string, error) {
+	if e.Envelope.From != "" || e.Envelope.NullSender {
+		return e.Envelope.From, nil
+	}
 
-	from, err = e.Header.Address("from")
+	var from, err = e.Header.Address("from")
 	if err != nil {
-		return errors.New(`mail.Send: invalid "from" field: ` + err.Error())
+		return "", errors.New(`invalid "from" field: ` + err.Error())
 	}
-	to, err = e.Header.AddressList("to")
-	if err != nil {
-		return errors.New(`mail.Send: invalid "to" field: ` + err.Error())
+	if from == nil {
+		return "", nil
+	}
+	return from.Address, nil
+}
+
+// Recipients returns the envelope recipients if any are set, otherwise the
+// addresses in the "to", "cc", and "bcc" header fields.  If every recipient
+// has been removed, the list is empty.
+func (e *Email) Recipients() ([]string, error) {
+	if len(e.Envelope.To) > 0 || e.Envelope.NoRecipients {
+		return e.Envelope.To, nil
+	}
+
+	var rcpts []string
+	for _, field := range []string{"to", "cc", "bcc"} {
+		var list, err = e.Header.AddressList(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %q field: %s", field, err)
+		}
+		for _, addr := range list {
+			rcpts = append(rcpts, addr.Address)
+		}
 	}
-	cc, err = e.Header.AddressList("cc")
+
+	return rcpts, nil
+}
+
+// Send uses the envelope (or header data when the envelope isn't set), Auth,
+// and the given host to attempt to send the message via smtp
+func (e *Email) Send(host string) error {
+	var from, err = e.Sender()
 	if err != nil {
-		return errors.New(`mail.Send: invalid "cc" field: ` + err.Error())
+		return errors.New("mail.Send: " + err.Error())
 	}
-	bcc, err = e.Header.AddressList("bcc")
+	var to []string
+	to, err = e.Recipients()
 	if err != nil {
-		return errors.New(`mail.Send: invalid "bcc" field: ` + err.Error())
+		return errors.New("mail.Send: " + err.Error())
 	}
 
-	if from == nil || len(to) == 0 {
+	if (from == "" && !e.Envelope.NullSender) || len(to) == 0 {
 		return errors.New("mail.Send: must have from and to addresses set")
 	}
 
+	return e.Mailer(host, e.Auth, from, to, e.Bytes())
+}
+
+// Bytes returns the message in wire format: the header as written by
+// Header.Write, a blank line, and the message body.  The result can be parsed
+// with ReadIgnoringDots to get an equivalent Email (less any Bcc header).
+func (e *Email) Bytes() []byte {
 	var b = new(bytes.Buffer)
 	e.Header.Write(b)
 	b.WriteString("\r\n\r\n")
 	b.Write(e.Message)
-
-	to = append(to, cc...)
-	to = append(to, bcc...)
-
-	return e.Mailer(host, e.Auth, from.String(), to.Strings(), b.Bytes())
+	return b.Bytes()
 }
@@ -71,6 +71,21 @@ func TestRead(t *testing.T) {
 	assert.Equal("hi", string(e.Message), "message", t)
 }
 
+func TestReadDot(t *testing.T) {
+	var data = "Subject: dots\nTo: you@example.org\n\nline one\n.\nline two"
+	var e, err = Read(bytes.NewBufferString(data))
+	if err != nil {
+		t.Fatalf("Couldn't read email: %s", err)
+	}
+	assert.Equal("line one", string(e.Message), "message stops at the lone dot", t)
+
+	e, err = ReadIgnoringDots(bytes.NewBufferString(data))
+	if err != nil {
+		t.Fatalf("Couldn't read email: %s", err)
+	}
+	assert.Equal("line one\r\n.\r\nline two", string(e.Message), "message keeps the lone dot", t)
+}
+
 func TestIgnoresDupeFields(t *testing.T) {
 	var e, err = Read(bytes.NewBufferString("Subject: hello\nTo: you@example.org\n" +
 		"From: me@example.org\nFrom: her <her@example.org>\n\nHello there!"))
@@ -87,18 +102,18 @@ func TestSend(t *testing.T) {
 	var f = new(fakeSentMessage)
 	var e = New()
 	e.Mailer = f.fakeMail
-	e.read(bytes.NewBufferString("To: Another cow <another+cow@example.org>\n" +
-		"CC: one@example.org,two@example.org\n" +
-		"bcc: uno@example.org\n" +
-		"Subject: Blah\n\n" +
-		"Hello!"))
+	e.read(bytes.NewBufferString("To: Another cow <another+cow@example.org>\n"+
+		"CC: one@example.org,two@example.org\n"+
+		"bcc: uno@example.org\n"+
+		"Subject: Blah\n\n"+
+		"Hello!"), true)
 	e.Header.Set("from", "Chicken <chicken@example.org>")
 
 	var host = "host:25"
 	e.Send(host)
 	assert.Equal(host, f.addr, "host", t)
-	assert.Equal(`"Chicken" <chicken@example.org>`, f.from, "from", t)
-	assert.Equal(`"Another cow" <another+cow@example.org>,<one@example.org>,<two@example.org>,<uno@example.org>`, strings.Join(f.to, ","), "to", t)
+	assert.Equal("chicken@example.org", f.from, "from", t)
+	assert.Equal("another+cow@example.org,one@example.org,two@example.org,uno@example.org", strings.Join(f.to, ","), "to", t)
 	assert.Equal(
 		"Cc: one@example.org,two@example.org\r\n"+
 			"From: Chicken <chicken@example.org>\r\n"+
@@ -107,6 +122,56 @@ func TestSend(t *testing.T) {
 			"\r\nHello!", string(f.msg), "massaged message: 'from' header added, 'bcc' removed, sorted headers", t)
 }
 
+func TestSendEnvelope(t *testing.T) {
+	var f = new(fakeSentMessage)
+	var e = New()
+	e.Mailer = f.fakeMail
+	e.read(bytes.NewBufferString("To: you@example.org\n"+
+		"From: Me <me@example.org>\n"+
+		"Subject: Blah\n\n"+
+		"Hello!"), true)
+	e.Envelope.From = "bounce+you=example.org@example.org"
+	e.Envelope.To = []string{"archive@example.org"}
+
+	e.Send("host:25")
+	assert.Equal("bounce+you=example.org@example.org", f.from, "envelope from", t)
+	assert.Equal("archive@example.org", strings.Join(f.to, ","), "envelope to", t)
+	assert.Equal(
+		"From: Me <me@example.org>\r\n"+
+			"Subject: Blah\r\n"+
+			"To: you@example.org\r\n"+
+			"\r\nHello!", string(f.msg), "headers are unaffected by the envelope", t)
+}
+
+func TestSendNullSender(t *testing.T) {
+	var f = new(fakeSentMessage)
+	var e = New()
+	e.Mailer = f.fakeMail
+	e.read(bytes.NewBufferString("To: you@example.org\n"+
+		"From: Mail Delivery System <mailer-daemon@example.org>\n"+
+		"Subject: Undeliverable\n\n"+
+		"Sorry!"), true)
+	e.Envelope.NullSender = true
+
+	var from, _ = e.Sender()
+	assert.Equal("", from, "null sender isn't replaced by the header", t)
+	f.from = "unset"
+	assert.NilError(e.Send("host:25"), "sending with the null sender", t)
+	assert.Equal("host:25", f.addr, "mailer was called", t)
+	assert.Equal("", f.from, "envelope from", t)
+	assert.Equal("you@example.org", strings.Join(f.to, ","), "envelope to", t)
+
+	// An empty sender is still an error when it isn't the null sender
+	var e2 = New()
+	e2.Mailer = new(fakeSentMessage).fakeMail
+	e2.Envelope.To = []string{"you@example.org"}
+	assert.True(e2.Send("host:25") != nil, "sending without a sender", t)
+
+	e.Envelope.From = "bounces@example.org"
+	from, _ = e.Sender()
+	assert.Equal("bounces@example.org", from, "a set sender overrides the null sender", t)
+}
+
 func TestHeaders(t *testing.T) {
 	var e = New()
 	e.Header.Set("from", "user@example.org")
@@ -114,3 +179,52 @@ func TestHeaders(t *testing.T) {
 	e.Header.Del("from")
 	assert.Equal("", e.Header.Get("from"), "from header is removed properly", t)
 }
+
+func TestClone(t *testing.T) {
+	var e = New()
+	e.Header.Set("from", "user@example.org")
+	e.Envelope.To = []string{"one@example.org"}
+	e.Message = []byte("hi")
+
+	var e2 = e.Clone()
+	e2.Header.Set("from", "other@example.org")
+	e2.Envelope.To[0] = "two@example.org"
+	e2.Message[0] = 'H'
+
+	assert.Equal("user@example.org", e.Header.Get("from"), "original header is unchanged", t)
+	assert.Equal("one@example.org", e.Envelope.To[0], "original envelope is unchanged", t)
+	assert.Equal("hi", string(e.Message), "original message is unchanged", t)
+	assert.Equal("other@example.org", e2.Header.Get("from"), "clone's header", t)
+}
+
+func TestHeaderValues(t *testing.T) {
+	var e, err = Read(bytes.NewBufferString("Received: one\nReceived: two\nX-Empty:\n\nhi"))
+	if err != nil {
+		t.Fatalf("Couldn't read email: %s", err)
+	}
+	assert.Equal(2, len(e.Header.Values("received")), "both values", t)
+	assert.Equal("two", e.Header.Values("Received")[1], "second value", t)
+	assert.Equal(1, len(e.Header.Values("x-empty")), "empty but present", t)
+	assert.True(e.Header.Values("x-nope") == nil, "missing", t)
+}
+
+func TestWriteRepeatedFields(t *testing.T) {
+	var e, err = Read(bytes.NewBufferString("Received: one\nSubject: hi\nReceived: two\nSubject: again\n\nhi"))
+	if err != nil {
+		t.Fatalf("Couldn't read email: %s", err)
+	}
+	e.Header.Add("x-tag", "a")
+	e.Header.Add("X-Tag", "b")
+
+	var buf = new(bytes.Buffer)
+	e.Header.Write(buf)
+	assert.Equal("Received: one\r\nReceived: two\r\nSubject: hi\r\nX-Tag: a\r\nX-Tag: b",
+		buf.String(), "repeatable fields keep every value in order", t)
+}
+
+func TestAppendAddress(t *testing.T) {
+	var list = AppendAddress(nil, "a@example.org")
+	list = AppendAddress(list, "b@example.org")
+	list = AppendAddress(list, "A@Example.org")
+	assert.Equal("a@example.org,b@example.org", strings.Join(list, ","), "duplicates are skipped case-insensitively", t)
+}
@@ -0,0 +1,246 @@
+package email
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"time"
+)
+
+// TLSMode tells a Dialer how (and whether) to encrypt its SMTP connection
+type TLSMode int
+
+// Available TLS modes.  TLSOpportunistic is the zero value, and mirrors what
+// smtp.SendMail does: STARTTLS is used if and only if the server offers it.
+const (
+	TLSOpportunistic TLSMode = iota
+	TLSNone
+	TLSRequired
+	TLSImplicit
+)
+
+// ParseTLSMode converts a config-friendly string into a TLSMode: "none",
+// "starttls", "required", or "implicit".  An empty string is the same as
+// "starttls".
+func ParseTLSMode(s string) (TLSMode, error) {
+	switch s {
+	case "", "starttls":
+		return TLSOpportunistic, nil
+	case "none":
+		return TLSNone, nil
+	case "required":
+		return TLSRequired, nil
+	case "implicit":
+		return TLSImplicit, nil
+	}
+	return TLSOpportunistic, fmt.Errorf("unknown tls mode %q", s)
+}
+
+// DefaultPort returns the SMTP port typically used with the given mode: 465
+// for implicit TLS, and 25 for everything else
+func (m TLSMode) DefaultPort() string {
+	if m == TLSImplicit {
+		return "465"
+	}
+	return "25"
+}
+
+// temporaryError marks an error as worth retrying; see Temporary
+type temporaryError struct {
+	err error
+}
+
+func (e *temporaryError) Error() string {
+	return e.err.Error()
+}
+
+func (e *temporaryError) Unwrap() error {
+	return e.err
+}
+
+// Temporary wraps err so IsTemporary reports it as temporary.  This is for
+// local failures which may well go away, like a password file which can't be
+// read right now.
+func Temporary(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &temporaryError{err}
+}
+
+// IsTemporary returns true if err looks like a failure worth retrying later:
+// an SMTP 4xx reply, a network error, the server hanging up on us, or an
+// error wrapped by Temporary
+func IsTemporary(err error) bool {
+	var tmpErr *temporaryError
+	if errors.As(err, &tmpErr) {
+		return true
+	}
+
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		return tpErr.Code >= 400 && tpErr.Code < 500
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// A Dialer connects to SMTP servers with the configured TLS settings.  Its
+// SendMail method has the same signature as smtp.SendMail, so it can be used
+// as an Email's Mailer.
+type Dialer struct {
+	TLS       TLSMode
+	TLSConfig *tls.Config
+
+	// Timeout, if set, limits how long connecting may take and how long any
+	// single read or write may block once connected, so a server which stops
+	// responding mid-session fails the send rather than hanging forever
+	Timeout time.Duration
+}
+
+// DefaultDialer is used by New for an Email's Mailer.  It behaves the same as
+// smtp.SendMail.
+var DefaultDialer = &Dialer{}
+
+// tlsConfig returns a copy of d.TLSConfig (or a new config if that's nil) with
+// ServerName filled in if it was empty
+func (d *Dialer) tlsConfig(host string) *tls.Config {
+	var cfg = &tls.Config{}
+	if d.TLSConfig != nil {
+		cfg = d.TLSConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	return cfg
+}
+
+// timeoutConn pushes its deadline back before every read and write, so the
+// connection only fails when the other side stalls for longer than timeout
+type timeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	var err = c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	if err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	var err = c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	if err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+// dial connects to addr, wrapping the connection in TLS immediately if the
+// dialer uses implicit TLS.  If the dialer has a timeout, it applies to the
+// whole session, not just connecting.
+func (d *Dialer) dial(addr, host string) (net.Conn, error) {
+	var nd = &net.Dialer{Timeout: d.Timeout}
+	var conn, err = nd.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if d.Timeout > 0 {
+		conn = &timeoutConn{Conn: conn, timeout: d.Timeout}
+	}
+	if d.TLS == TLSImplicit {
+		var tc = tls.Client(conn, d.tlsConfig(host))
+		err = tc.Handshake()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+	return conn, nil
+}
+
+// SendMail connects to the server at addr, secures the connection according
+// to d.TLS, authenticates with a if it isn't nil, and sends msg from the given
+// sender to all recipients in to
+func (d *Dialer) SendMail(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+	var host, _, err = net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	var conn net.Conn
+	conn, err = d.dial(addr, host)
+	if err != nil {
+		return err
+	}
+
+	var c *smtp.Client
+	c, err = smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if d.TLS == TLSOpportunistic || d.TLS == TLSRequired {
+		var ok, _ = c.Extension("STARTTLS")
+		if ok {
+			err = c.StartTLS(d.tlsConfig(host))
+			if err != nil {
+				return err
+			}
+		} else if d.TLS == TLSRequired {
+			return errors.New("mail: server doesn't support STARTTLS")
+		}
+	}
+
+	if a != nil {
+		var ok, _ = c.Extension("AUTH")
+		if !ok {
+			return errors.New("mail: server doesn't support AUTH")
+		}
+		err = c.Auth(a)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = c.Mail(from)
+	if err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		err = c.Rcpt(rcpt)
+		if err != nil {
+			return err
+		}
+	}
+
+	var w io.WriteCloser
+	w, err = c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(msg)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
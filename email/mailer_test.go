@@ -0,0 +1,161 @@
+package email
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uoregon-libraries/gopkg/assert"
+)
+
+// fakeServer is a bare-bones SMTP server which accepts a single connection,
+// advertises the given extensions, and records the commands it receives
+type fakeServer struct {
+	l        net.Listener
+	exts     []string
+	commands []string
+	data     string
+	done     chan struct{}
+}
+
+func newFakeServer(t *testing.T, exts ...string) *fakeServer {
+	var l, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	var s = &fakeServer{l: l, exts: exts, done: make(chan struct{})}
+	go s.serve()
+	return s
+}
+
+func (s *fakeServer) serve() {
+	defer close(s.done)
+	var conn, err = s.l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	var tp = textproto.NewConn(conn)
+	tp.PrintfLine("220 fake ESMTP")
+	for {
+		var line, err = tp.ReadLine()
+		if err != nil {
+			return
+		}
+		s.commands = append(s.commands, line)
+		var cmd = strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch cmd {
+		case "EHLO":
+			var lines = append([]string{"fake"}, s.exts...)
+			for i, l := range lines {
+				var sep = "-"
+				if i == len(lines)-1 {
+					sep = " "
+				}
+				tp.PrintfLine("250%s%s", sep, l)
+			}
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			var b, _ = tp.ReadDotBytes()
+			s.data = string(b)
+			tp.PrintfLine("250 ok")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("250 ok")
+		}
+	}
+}
+
+func (s *fakeServer) close() {
+	s.l.Close()
+	<-s.done
+}
+
+func TestParseTLSMode(t *testing.T) {
+	var tests = map[string]TLSMode{
+		"":         TLSOpportunistic,
+		"starttls": TLSOpportunistic,
+		"none":     TLSNone,
+		"required": TLSRequired,
+		"implicit": TLSImplicit,
+	}
+	for s, expected := range tests {
+		var m, err = ParseTLSMode(s)
+		assert.NilError(err, "parsing "+s, t)
+		assert.Equal(expected, m, "mode for "+s, t)
+	}
+
+	var _, err = ParseTLSMode("sometimes")
+	assert.True(err != nil, "invalid mode returns an error", t)
+	assert.Equal("465", TLSImplicit.DefaultPort(), "implicit TLS port", t)
+	assert.Equal("25", TLSRequired.DefaultPort(), "STARTTLS port", t)
+}
+
+func TestDialerSendMail(t *testing.T) {
+	var s = newFakeServer(t)
+	var d = &Dialer{TLS: TLSNone}
+	var err = d.SendMail(s.l.Addr().String(), nil, "me@example.org", []string{"you@example.org"}, []byte("Subject: hi\r\n\r\nhello"))
+	s.close()
+
+	assert.NilError(err, "sending mail", t)
+	assert.Equal("MAIL FROM:<me@example.org>", s.commands[1], "MAIL command", t)
+	assert.Equal("RCPT TO:<you@example.org>", s.commands[2], "RCPT command", t)
+	assert.Equal("Subject: hi\n\nhello\n", s.data, "message data", t)
+}
+
+func TestDialerRequiresSTARTTLS(t *testing.T) {
+	var s = newFakeServer(t, "8BITMIME")
+	var d = &Dialer{TLS: TLSRequired}
+	var err = d.SendMail(s.l.Addr().String(), nil, "me@example.org", []string{"you@example.org"}, []byte("hello"))
+	s.close()
+
+	assert.True(err != nil, "sending without STARTTLS support should fail", t)
+	for _, cmd := range s.commands {
+		if strings.HasPrefix(cmd, "MAIL") {
+			t.Errorf("Dialer shouldn't have sent %q without TLS", cmd)
+		}
+	}
+}
+
+func TestDialerTimeout(t *testing.T) {
+	// The listener accepts connections (via the kernel's backlog) but never
+	// says anything
+	var l, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer l.Close()
+
+	var d = &Dialer{TLS: TLSNone, Timeout: 100 * time.Millisecond}
+	var done = make(chan error, 1)
+	go func() {
+		done <- d.SendMail(l.Addr().String(), nil, "me@example.org", []string{"you@example.org"}, []byte("hello"))
+	}()
+
+	select {
+	case err = <-done:
+		assert.True(err != nil, "a server which never responds is an error", t)
+		assert.True(IsTemporary(err), "the timeout is temporary: "+err.Error(), t)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("SendMail didn't time out")
+	}
+}
+
+func TestIsTemporary(t *testing.T) {
+	var _, dialErr = net.Dial("tcp", "127.0.0.1:0")
+	assert.True(IsTemporary(&textproto.Error{Code: 451, Msg: "try later"}), "4xx is temporary", t)
+	assert.False(IsTemporary(&textproto.Error{Code: 550, Msg: "no such user"}), "5xx is permanent", t)
+	assert.True(IsTemporary(dialErr), "connection errors are temporary", t)
+	assert.True(IsTemporary(io.EOF), "hangups are temporary", t)
+	assert.False(IsTemporary(errors.New("mail: server doesn't support STARTTLS")), "other errors are permanent", t)
+	assert.True(IsTemporary(fmt.Errorf("wrapped: %w", Temporary(errors.New("no password")))), "errors marked temporary", t)
+	assert.True(Temporary(nil) == nil, "Temporary(nil) is nil", t)
+}
@@ -0,0 +1,203 @@
+package email
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+)
+
+// maxPartDepth limits how deeply nested multipart sections are parsed.
+// Anything deeper is treated as a single opaque part.
+const maxPartDepth = 10
+
+// Part is a single MIME part of a message with its transfer encoding decoded.
+// Multipart sections are flattened, so only the leaves show up as Parts.
+type Part struct {
+	// ContentType is the lowercased media type, e.g., "text/plain", without
+	// any parameters
+	ContentType string
+
+	// Filename is the part's file name from its Content-Disposition or
+	// Content-Type header, if any
+	Filename string
+
+	// Attachment is true if the part is marked as an attachment or has a
+	// file name
+	Attachment bool
+
+	Body []byte
+}
+
+// parsedMessage holds the result of parsing a message's MIME parts, along
+// with what the parse depended on: the message data and the header fields
+// which say how to read it.  If any of those change, the cache is stale.
+type parsedMessage struct {
+	message     []byte
+	contentType string
+	encoding    string
+
+	parts []*Part
+	text  string
+	err   error
+}
+
+// validFor returns true if the parse still describes the email.  Message is
+// compared by identity, since it's replaced rather than modified in place.
+func (p *parsedMessage) validFor(e *Email) bool {
+	return p != nil && len(p.message) == len(e.Message) &&
+		(len(e.Message) == 0 || &p.message[0] == &e.Message[0]) &&
+		p.contentType == e.Header.Get("Content-Type") &&
+		p.encoding == e.Header.Get("Content-Transfer-Encoding")
+}
+
+// forCopy returns the cache for a copy of e whose message data is the same
+// but lives in a different slice, or nil if there's nothing valid to carry over
+func (p *parsedMessage) forCopy(e, e2 *Email) *parsedMessage {
+	if !p.validFor(e) {
+		return nil
+	}
+	var p2 = *p
+	p2.message = e2.Message
+	return &p2
+}
+
+// parse returns the email's parsed parts, parsing them the first time they're
+// needed and again only if the message or its MIME header fields change
+func (e *Email) parse() *parsedMessage {
+	if e.parsed.validFor(e) {
+		return e.parsed
+	}
+
+	var p = &parsedMessage{
+		message:     e.Message,
+		contentType: e.Header.Get("Content-Type"),
+		encoding:    e.Header.Get("Content-Transfer-Encoding"),
+	}
+	p.parts, p.err = readParts(textproto.MIMEHeader(e.Header.h), e.Message, 0)
+
+	var texts []string
+	for _, part := range p.parts {
+		if !part.Attachment && strings.HasPrefix(part.ContentType, "text/") {
+			texts = append(texts, string(part.Body))
+		}
+	}
+	p.text = strings.Join(texts, "\n")
+
+	e.parsed = p
+	return p
+}
+
+// Parts parses the message body into its MIME parts.  A message which isn't
+// multipart is a single part.  If the message is malformed, the parts read
+// before the problem was found are returned along with the error.
+//
+// The parts are cached, so they mustn't be modified.  Every matcher which
+// looks at the body can call Parts without the message being parsed again.
+func (e *Email) Parts() ([]*Part, error) {
+	var p = e.parse()
+	return p.parts, p.err
+}
+
+func readParts(h textproto.MIMEHeader, body []byte, depth int) ([]*Part, error) {
+	// RFC 2045 says a missing or invalid Content-Type means plain text
+	var mediaType, params, err = mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", nil
+	}
+
+	if !strings.HasPrefix(mediaType, "multipart/") || depth >= maxPartDepth {
+		return []*Part{newPart(h, mediaType, params, body)}, nil
+	}
+
+	var parts []*Part
+	var r = multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		var p *multipart.Part
+		p, err = r.NextRawPart()
+		if err == io.EOF {
+			return parts, nil
+		}
+		if err != nil {
+			return parts, err
+		}
+
+		var data []byte
+		data, err = ioutil.ReadAll(p)
+		if err != nil {
+			return parts, err
+		}
+
+		var sub []*Part
+		sub, err = readParts(p.Header, data, depth+1)
+		parts = append(parts, sub...)
+		if err != nil {
+			return parts, err
+		}
+	}
+}
+
+// newPart builds a leaf Part, decoding its body.  If the body can't be
+// decoded, it's left as-is.
+func newPart(h textproto.MIMEHeader, mediaType string, params map[string]string, body []byte) *Part {
+	var p = &Part{ContentType: mediaType, Body: body}
+
+	var disposition, dparams, _ = mime.ParseMediaType(h.Get("Content-Disposition"))
+	p.Filename = dparams["filename"]
+	if p.Filename == "" {
+		p.Filename = params["name"]
+	}
+	var dec = new(mime.WordDecoder)
+	var name, err = dec.DecodeHeader(p.Filename)
+	if err == nil {
+		p.Filename = name
+	}
+	p.Attachment = disposition == "attachment" || p.Filename != ""
+
+	var r io.Reader
+	switch strings.ToLower(strings.TrimSpace(h.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, bytes.NewReader(body))
+	case "quoted-printable":
+		r = quotedprintable.NewReader(bytes.NewReader(body))
+	default:
+		return p
+	}
+
+	var decoded []byte
+	decoded, err = ioutil.ReadAll(r)
+	if err == nil {
+		p.Body = decoded
+	}
+	return p
+}
+
+// Text returns the decoded text of the message: every text part which isn't
+// an attachment, separated by newlines.  If the message is malformed, the
+// text of the parts read before the problem was found is returned along with
+// the error.
+func (e *Email) Text() (string, error) {
+	var p = e.parse()
+	return p.text, p.err
+}
+
+// byteCounter is an io.Writer which only counts what's written to it
+type byteCounter int
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// Size returns the size in bytes of the message as it would be sent.  Only
+// the header is written out to measure it, not the whole message.
+func (e *Email) Size() int {
+	var c byteCounter
+	e.Header.Write(&c)
+	return int(c) + len("\r\n\r\n") + len(e.Message)
+}
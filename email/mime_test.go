@@ -0,0 +1,103 @@
+package email
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/uoregon-libraries/gopkg/assert"
+)
+
+var multipartMessage = `From: me@example.org
+To: you@example.org
+Content-Type: multipart/mixed; boundary="outer"
+
+--outer
+Content-Type: multipart/alternative; boundary="inner"
+
+--inner
+Content-Type: text/plain; charset=utf-8
+Content-Transfer-Encoding: quoted-printable
+
+Hello, caf=C3=A9 world
+--inner
+Content-Type: text/html
+
+<p>Hello</p>
+--inner--
+--outer
+Content-Type: application/pdf; name="report.pdf"
+Content-Disposition: attachment; filename="=?utf-8?q?r=C3=A9port.pdf?="
+Content-Transfer-Encoding: base64
+
+JVBERi0xLjQK
+--outer--
+`
+
+func TestParts(t *testing.T) {
+	var e, err = Read(bytes.NewBufferString(multipartMessage))
+	if err != nil {
+		t.Fatalf("Couldn't read email: %s", err)
+	}
+
+	var parts []*Part
+	parts, err = e.Parts()
+	assert.NilError(err, "parsing parts", t)
+	assert.Equal(3, len(parts), "leaf parts", t)
+	assert.Equal("text/plain", parts[0].ContentType, "first part type", t)
+	assert.Equal("Hello, café world", string(parts[0].Body), "quoted-printable is decoded", t)
+	assert.Equal("text/html", parts[1].ContentType, "second part type", t)
+	assert.False(parts[1].Attachment, "html isn't an attachment", t)
+	assert.Equal("application/pdf", parts[2].ContentType, "attachment type", t)
+	assert.Equal("réport.pdf", parts[2].Filename, "attachment name is decoded", t)
+	assert.True(parts[2].Attachment, "pdf is an attachment", t)
+	assert.Equal("%PDF-1.4\n", string(parts[2].Body), "base64 is decoded", t)
+
+	var text string
+	text, err = e.Text()
+	assert.NilError(err, "reading text", t)
+	assert.Equal("Hello, café world\n<p>Hello</p>", text, "text skips attachments", t)
+}
+
+func TestPartsPlain(t *testing.T) {
+	var e, err = Read(bytes.NewBufferString("From: me@example.org\n\nJust text"))
+	if err != nil {
+		t.Fatalf("Couldn't read email: %s", err)
+	}
+
+	var parts []*Part
+	parts, err = e.Parts()
+	assert.NilError(err, "parsing parts", t)
+	assert.Equal(1, len(parts), "a plain message is one part", t)
+	assert.Equal("text/plain", parts[0].ContentType, "default type", t)
+	assert.Equal(len(e.Bytes()), e.Size(), "size", t)
+}
+
+func TestPartsCache(t *testing.T) {
+	var e, err = Read(bytes.NewBufferString(multipartMessage))
+	if err != nil {
+		t.Fatalf("Couldn't read email: %s", err)
+	}
+
+	var parts, _ = e.Parts()
+	var again, _ = e.Parts()
+	assert.True(&parts[0] == &again[0], "parts are only parsed once", t)
+	assert.Equal(len(e.Bytes()), e.Size(), "size", t)
+
+	var e2 = e.Clone()
+	again, _ = e2.Parts()
+	assert.True(&parts[0] == &again[0], "a clone shares the parsed parts", t)
+
+	e.Header.Set("X-Tag", "tagged")
+	again, _ = e.Parts()
+	assert.True(&parts[0] == &again[0], "unrelated header changes keep the cache", t)
+	assert.Equal(len(e.Bytes()), e.Size(), "size after a header change", t)
+
+	e.Header.Set("Content-Type", "text/plain")
+	again, _ = e.Parts()
+	assert.Equal(1, len(again), "changing the content type reparses", t)
+
+	e2.Message = append([]byte(nil), e2.Message...)
+	again, _ = e2.Parts()
+	assert.False(&parts[0] == &again[0], "replacing the message reparses", t)
+	assert.Equal(3, len(again), "reparsed message", t)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Nerdmaster/sendmail/smtpd"
+)
+
+// fakeServer is an SMTP server which accepts mail for any recipient except
+// those at bad.example, recording who it delivered to and from.  If reply is
+// set, every message gets that reply code instead.
+type fakeServer struct {
+	addr      string
+	reply     int
+	mu        sync.Mutex
+	delivered []string
+	senders   []string
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	var l, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	var fs = &fakeServer{addr: l.Addr().String()}
+	var s = &smtpd.Server{Hostname: "localhost", Handler: fs.handle}
+	go s.Serve(l)
+	return fs
+}
+
+func (fs *fakeServer) handle(from string, to []string, data []byte) error {
+	if fs.reply != 0 {
+		return &smtpd.Error{Code: fs.reply, Message: "fake reply"}
+	}
+	for _, rcpt := range to {
+		if strings.HasSuffix(rcpt, "@bad.example") {
+			return &smtpd.Error{Code: 550, Message: "no such user"}
+		}
+	}
+	fs.mu.Lock()
+	fs.delivered = append(fs.delivered, to...)
+	fs.senders = append(fs.senders, "<"+from+">")
+	fs.mu.Unlock()
+	return nil
+}
+
+func (fs *fakeServer) recipients() string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return strings.Join(fs.delivered, ",")
+}
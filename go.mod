@@ -1,5 +1,7 @@
 module github.com/Nerdmaster/sendmail
 
+go 1.14
+
 require (
 	github.com/go-yaml/yaml v2.1.0+incompatible
 	github.com/jessevdk/go-flags v1.4.0
@@ -2,133 +2,344 @@ package main
 
 import (
 	"errors"
-	"io/ioutil"
+	"fmt"
 	"log"
 	"net/mail"
-	"net/smtp"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/Nerdmaster/sendmail/email"
-	"github.com/go-yaml/yaml"
+	"github.com/Nerdmaster/sendmail/rule"
 	flags "github.com/jessevdk/go-flags"
 )
 
 var opts struct {
-	From    string `short:"f" description:"From address"`
-	Dryrun  bool   `short:"n" description:"Dry run; do not send an email message"`
-	Verbose bool   `short:"v" description:"Verbose mode"`
+	From       string   `short:"f" description:"From address"`
+	Sender     string   `short:"r" description:"Alias for -f"`
+	FullName   string   `short:"F" description:"Display name to use in the From header"`
+	ReadRcpts  bool     `short:"t" description:"Read recipients from the To, Cc, and Bcc headers in addition to any given as arguments"`
+	IgnoreDots bool     `short:"i" description:"Do not treat a line with a single dot as the end of the message"`
+	Options    []string `short:"o" description:"Set a sendmail option; only \"-oi\" (same as -i) has any effect"`
+	BodyType   string   `short:"B" description:"Body type (ignored; accepted for compatibility)"`
+	DSNNotify  string   `short:"N" description:"DSN notification conditions (ignored; accepted for compatibility)"`
+	DSNReturn  string   `short:"R" description:"DSN return type (ignored; accepted for compatibility)"`
+	DSNEnvID   string   `short:"V" description:"DSN envelope ID (ignored; accepted for compatibility)"`
+	Config     string   `short:"C" long:"config" env:"GO_SENDMAIL_CONFIG" description:"Config file or directory (default: /etc/go-sendmail.yml)"`
+	Dryrun     bool     `short:"n" description:"Dry run; do not send an email message"`
+	Verbose    bool     `short:"v" description:"Verbose mode"`
+
+	Mode    string   `short:"b" default:"m" description:"Operating mode: m (deliver a message from stdin), p (list the queue), s (speak SMTP on stdin/stdout), d (listen for SMTP connections), or t (test rules)"`
+	Listen  string   `long:"listen" default:"127.0.0.1:25" description:"Address for -bd mode: host:port, or unix:/path/to/socket"`
+	Headers []string `long:"header" description:"Header line to test with -bt (e.g., --header \"From: me@example.com\"); stdin is read if none are given"`
+
+	QueueRun      string        `short:"q" optional:"yes" optional-value:"once" description:"Retry queued messages once, or every interval if one is given (e.g., -q30m)"`
+	QueueDir      string        `long:"queue-dir" default:"/var/spool/go-sendmail" description:"Directory for messages awaiting a retry"`
+	QueueLifetime time.Duration `long:"queue-lifetime" default:"120h" description:"How long to keep retrying a queued message before giving up"`
+
+	Queue queueCommands `command:"queue" description:"Inspect and manage queued messages"`
+	Serve struct{}      `command:"serve" description:"Listen for SMTP connections (same as -bd)"`
+	Test  struct{}      `command:"test-rules" description:"Explain which rule matches a message and what it would do (same as -bt)"`
+	Check struct{}      `command:"check-config" description:"Report every problem in the config file, exiting non-zero if there are any"`
 }
 
 func fatalWithEmail(e *email.Email, err error) {
-	var from = e.Header.Get("from")
-	var to = e.Header.Get("to")
+	var from, _ = e.Sender()
+	var to, _ = e.Recipients()
 	log.Fatalf("Unable to send email (from %q, to %q, msg %q): %s", from, to, e.Message, err)
 }
 
 func main() {
-	var args, err = flags.Parse(&opts)
+	var parser = flags.NewParser(&opts, flags.Default)
+	parser.SubcommandsOptional = true
+	var args, err = parser.Parse()
 	if err != nil {
 		log.Fatalf("Unable to parse CLI flags: %s", err)
 	}
+	applyOptions(parser)
 
-	var rules = readRules()
-	if len(rules) == 0 {
-		log.Fatalf("No rules configured")
+	// Like sendmail, we list the queue when invoked as "mailq"
+	if filepath.Base(os.Args[0]) == "mailq" {
+		opts.Mode = "p"
+	}
+	if parser.Active != nil {
+		switch parser.Active.Name {
+		case "queue":
+			runQueueCommand(parser.Active)
+			return
+		case "serve":
+			opts.Mode = "d"
+		case "test-rules":
+			opts.Mode = "t"
+		case "check-config":
+			checkConfig()
+			return
+		}
+	}
+
+	switch opts.Mode {
+	case "m":
+	case "p":
+		listQueue()
+		return
+	case "s":
+		serveStdio(loadRules())
+		return
+	case "d":
+		serveDaemon(loadRules())
+		return
+	case "t":
+		testRules(loadRules(), args)
+		return
+	default:
+		log.Fatalf("Unsupported mode -b%s", opts.Mode)
+	}
+
+	var rules = loadRules()
+	if opts.QueueRun != "" {
+		runQueue(rules)
+		return
 	}
+
 	var e *email.Email
-	e, err = email.Read(os.Stdin)
+	if opts.IgnoreDots {
+		e, err = email.ReadIgnoringDots(os.Stdin)
+	} else {
+		e, err = email.Read(os.Stdin)
+	}
 	if err != nil {
 		log.Fatalf("Unable to read stdin: %s", err)
 	}
 	applyArgs(e, args)
 
-	var matchFound bool
-	for i, rule := range rules {
+	err = deliver(rules, e)
+	var rej *rejectError
+	if errors.As(err, &rej) {
+		fmt.Fprintln(os.Stderr, rej.reason)
+		os.Exit(exitNoPerm)
+	}
+	// This includes split delivery's partial failures, so the recipients who
+	// didn't get the message are reported along with it
+	if err != nil {
+		fatalWithEmail(e, err)
+	}
+}
+
+// exitNoPerm is sendmail's exit status (EX_NOPERM from sysexits.h) for a
+// message which was refused
+const exitNoPerm = 77
+
+// rejectError is returned by deliver when a rule's Reject action refuses a
+// message
+type rejectError struct {
+	reason string
+}
+
+func (e *rejectError) Error() string {
+	return "rejected: " + e.reason
+}
+
+// errDeferred is recorded as the queue entry's error for messages queued by a
+// rule's Defer action
+var errDeferred = errors.New("delivery deferred by rule")
+
+// errNoMatch is returned by deliver when none of the rules match a message
+var errNoMatch = errors.New("no rules matched")
+
+// deliver processes the email with the first rule that matches it, or splits
+// it up by recipient if split delivery is on
+func deliver(rules []*RuleConf, e *email.Email) error {
+	if splitRecipients {
+		return deliverSplit(rules, e)
+	}
+
+	var chain = matchRules(rules, e)
+	if chain == nil {
+		return errNoMatch
+	}
+	return process(rules, chain, e)
+}
+
+// ruleMatch is a rule which matched a message, and the capture groups from
+// the rule's regex matchers
+type ruleMatch struct {
+	index    int
+	captures rule.Captures
+}
+
+// matchRules returns the rules which will handle the email: every matching
+// "continue" rule up to the first matching rule which doesn't continue, which
+// is last.  Every rule is matched against the email as it arrived, not as
+// earlier rules' actions would leave it.  If no rule matches without
+// continuing, nil is returned.
+func matchRules(rules []*RuleConf, e *email.Email) []ruleMatch {
+	var chain []ruleMatch
+	for i, r := range rules {
 		if opts.Verbose {
-			log.Printf("DEBUG: Trying rule %d (matchers: %#v)", i, rule.Matchers)
+			log.Printf("DEBUG: Trying rule %d (matchers: %s)", i, r.Matchers)
 		}
-		if process(rule, e) {
-			matchFound = true
-			break
+		var matched, caps = r.rule.MatchCaptures(e)
+		if matched {
+			chain = append(chain, ruleMatch{index: i, captures: caps})
+			if !r.Continue {
+				return chain
+			}
 		}
 	}
 
-	if !matchFound {
-		fatalWithEmail(e, errors.New("no rules matched"))
-	}
+	return nil
 }
 
-// process tries to match the rule against the email, setting up auth and
-// sending the message if it matches.  Returns whether processing occurred.
-func process(r *RuleConf, e *email.Email) bool {
-	if !r.rule.Match(e) {
-		return false
+// applyChain runs the actions of each rule in the chain on the email, in
+// order, stopping at the first action which fails
+func applyChain(rules []*RuleConf, chain []ruleMatch, e *email.Email) error {
+	for _, m := range chain {
+		var r = rules[m.index]
+		if opts.Verbose {
+			log.Printf("DEBUG: Matched rule %d (matchers: %s, captures: %v)", m.index, r.Matchers, m.captures)
+		}
+		if opts.Verbose && len(r.Actions) > 0 {
+			log.Printf("DEBUG: Running actions (%#v)", r.Actions)
+		}
+		var err = r.rule.ApplyCaptures(e, m.captures)
+		if err != nil {
+			return fmt.Errorf("rule %d: %s", m.index, err)
+		}
 	}
+	return nil
+}
 
-	if opts.Verbose {
-		log.Printf("DEBUG: Matched rule (matchers: %#v)", r.Matchers)
+// process runs the actions of the matched rules on the email and sends the
+// message via the last of them.  Temporary delivery failures put the message
+// in the queue to be retried later, so only permanent failures (or failing to
+// queue the message) return an error.
+func process(rules []*RuleConf, chain []ruleMatch, e *email.Email) error {
+	var err = applyChain(rules, chain, e)
+	if err != nil {
+		return err
 	}
+	var last = chain[len(chain)-1]
+	var r = rules[last.index]
 
-	var a = r.Auth
-	e.Auth = smtp.PlainAuth("", a.Username, a.Password, a.Host)
-
-	if opts.Verbose && len(r.Actions) > 0 {
-		log.Printf("DEBUG: Running actions (%#v)", r.Actions)
+	var disposition, reason = r.rule.Disposition()
+	if disposition != rule.Reject && e.Envelope.NoRecipients {
+		var from, _ = e.Sender()
+		log.Printf("Discarded email (from %q): the rules' actions removed every recipient", from)
+		return nil
+	}
+	switch disposition {
+	case rule.Discard:
+		var from, _ = e.Sender()
+		var to, _ = e.Recipients()
+		log.Printf("Discarded email (from %q, to %q)", from, to)
+		return nil
+	case rule.Reject:
+		return &rejectError{reason: reason}
+	case rule.Defer:
+		if opts.Dryrun {
+			log.Printf("Dry run requested; not queueing deferred email")
+			return nil
+		}
+		return enqueue(rules, last, e, errDeferred)
 	}
-	r.rule.Apply(e)
 
 	// Try to send it
 	if opts.Verbose {
-		log.Printf("DEBUG: trying to send email from %q to %q, message follows",
-			e.Header.Get("from"), e.Header.Get("to"))
+		var from, _ = e.Sender()
+		var to, _ = e.Recipients()
+		log.Printf("DEBUG: trying to send email from %q to %q, message follows", from, to)
 		log.Println(string(e.Message))
 	}
 
 	if opts.Dryrun {
 		log.Printf("Dry run requested; not sending email")
-	} else {
-		var err = e.Send(a.Server)
-		if err != nil {
-			fatalWithEmail(e, err)
-		}
+		return nil
 	}
 
-	return true
+	err = r.send(e, last.captures)
+	if err != nil && email.IsTemporary(err) {
+		err = enqueue(rules, last, e, err)
+	}
+	return err
 }
 
-func readRules() []*RuleConf {
-	var err error
-	var fname = "config.yml"
-	_, err = os.Stat("config.yml")
-	if os.IsNotExist(err) {
-		fname = "/etc/go-sendmail.yml"
+// loadRules reads the configured rules, exiting if there aren't any
+func loadRules() []*RuleConf {
+	var rules = readRules()
+	if len(rules) == 0 {
+		log.Fatalf("No rules configured")
 	}
+	return rules
+}
 
-	var data []byte
-	data, err = ioutil.ReadFile(fname)
-	if err != nil {
-		log.Fatalf("Unable to open %q: %s", fname, err)
+// applyOptions normalizes sendmail's aliased and "-o" style flags so the rest
+// of the code only has to look at one field for each setting.  An empty "-f"
+// or "-r" is the null sender, the same as "-f <>".
+func applyOptions(parser *flags.Parser) {
+	if opts.Sender != "" && opts.From == "" {
+		opts.From = opts.Sender
+	}
+	if opts.From == "" && (parser.FindOptionByShortName('f').IsSet() || parser.FindOptionByShortName('r').IsSet()) {
+		opts.From = "<>"
 	}
 
-	var rlist []*RuleConf
-	err = yaml.Unmarshal(data, &rlist)
-	if err != nil {
-		log.Fatalf("Unable to parse yaml: %s", err)
+	for _, o := range opts.Options {
+		switch o {
+		case "i":
+			opts.IgnoreDots = true
+		default:
+			if opts.Verbose {
+				log.Printf("DEBUG: Ignoring unsupported option -o%s", o)
+			}
+		}
 	}
 
-	initRules(rlist)
-	return rlist
+	if opts.Verbose {
+		for flag, val := range map[string]string{"B": opts.BodyType, "N": opts.DSNNotify, "R": opts.DSNReturn, "V": opts.DSNEnvID} {
+			if val != "" {
+				log.Printf("DEBUG: Ignoring unsupported flag -%s %q", flag, val)
+			}
+		}
+	}
 }
 
+// applyArgs sets up the envelope from the CLI flags and recipient arguments.
+// Headers are only touched when they'd otherwise be missing, or when "-F"
+// explicitly asks for a new display name.
 func applyArgs(e *email.Email, args []string) {
-	if opts.From != "" {
+	if opts.From == "<>" {
+		e.Envelope.From = ""
+		e.Envelope.NullSender = true
+	}
+	if opts.From != "" && opts.From != "<>" {
 		var from, err = mail.ParseAddress(opts.From)
 		if err != nil {
 			log.Fatalf(`Unable to set "from" address %q: %s`, opts.From, err)
 		}
+		e.Envelope.From = from.Address
+		if e.Header.Get("from") == "" {
+			e.Header.Set("from", from.String())
+		}
+	}
+
+	if opts.FullName != "" {
+		var from, err = e.Header.Address("from")
+		if err != nil || from == nil {
+			log.Fatalf(`Unable to set "from" name %q: no valid "from" address`, opts.FullName)
+		}
+		from.Name = opts.FullName
 		e.Header.Set("from", from.String())
 	}
 
+	var rcpts []string
+	if opts.ReadRcpts {
+		var err error
+		rcpts, err = e.Recipients()
+		if err != nil {
+			log.Fatalf("Unable to read recipients from headers: %s", err)
+		}
+	}
+
 	var tolist email.AddressList
 	for _, arg := range args {
 		var to, err = mail.ParseAddress(arg)
@@ -136,8 +347,11 @@ func applyArgs(e *email.Email, args []string) {
 			log.Fatalf(`Unable to set "to" address %q: %s`, arg, err)
 		}
 		tolist = append(tolist, to)
+		rcpts = email.AppendAddress(rcpts, to.Address)
 	}
-	if len(tolist) > 0 {
+	if len(tolist) > 0 && e.Header.Get("to") == "" {
 		e.Header.Set("to", tolist.String())
 	}
+
+	e.Envelope.To = rcpts
 }
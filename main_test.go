@@ -0,0 +1,207 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Nerdmaster/sendmail/email"
+	flags "github.com/jessevdk/go-flags"
+	"github.com/uoregon-libraries/gopkg/assert"
+)
+
+// captureStdout returns everything fn writes to stdout
+func captureStdout(t *testing.T, fn func()) string {
+	var r, w, err = os.Pipe()
+	if err != nil {
+		t.Fatalf("Unable to create pipe: %s", err)
+	}
+	var saved = os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = saved }()
+
+	var out = make(chan string)
+	go func() {
+		var data, _ = ioutil.ReadAll(r)
+		r.Close()
+		out <- string(data)
+	}()
+	fn()
+	w.Close()
+	return <-out
+}
+
+func TestContinueRules(t *testing.T) {
+	var rules = mkrules(t, ""+
+		"- matchers: [\"To/domain:example.org\"]\n  continue: true\n"+
+		"  actions: [\"SetHeader X-Tag:tagged\", \"DelHeader Subject\"]\n"+
+		"- matchers: [\"X-Tag:tagged\"]\n  actions: ['Discard']\n"+
+		"- matchers: [\"Subject:hi\"]\n  actions: [\"SetHeader X-Sent:yes\"]\n  auth: {server: \"127.0.0.1:1\", mechanism: none, tls: none}\n"+
+		"- matchers: [\"To/domain:other.example\"]\n  continue: true\n  actions: [\"SetHeader X-Other:yes\"]\n")
+
+	var e = mkemail(t, "a@example.org")
+	var chain = matchRules(rules, e)
+	assert.Equal(2, len(chain), "chain length", t)
+	assert.Equal(0, chain[0].index, "the continue rule is first", t)
+	assert.Equal(2, chain[1].index, "rules are matched against the message as it arrived", t)
+
+	assert.NilError(applyChain(rules, chain, e), "applying the chain", t)
+	assert.Equal("tagged", e.Header.Get("x-tag"), "continue rule's actions are applied", t)
+	assert.Equal("", e.Header.Get("subject"), "continue rule's actions are applied", t)
+	assert.Equal("yes", e.Header.Get("x-sent"), "sending rule's actions are applied after", t)
+
+	e, _ = email.Read(strings.NewReader("From: me@example.com\nTo: a@other.example\nSubject: other\n\nhi"))
+	assert.True(matchRules(rules, e) == nil, "a chain of only continue rules doesn't match", t)
+}
+
+func TestContinueRuleValidation(t *testing.T) {
+	var tests = map[string]string{
+		"auth":      "  auth: {server: \"127.0.0.1:25\", mechanism: none, tls: none}\n",
+		"transport": "  transport: relay\n",
+		"Discard":   "  actions: ['Discard']\n",
+		"Reject":    "  actions: ['Reject \"no\"']\n",
+		"Defer":     "  actions: ['Defer']\n",
+	}
+	for name, settings := range tests {
+		var data = "transports:\n  relay: {server: \"127.0.0.1:25\", mechanism: none, tls: none}\n" +
+			"rules:\n- matchers: [\"*\"]\n  continue: true\n" + settings
+		var dir = mkconfig(t, map[string]string{"c.yml": data})
+		var l = newConfigLoader(false)
+		var rlist, err = l.load(filepath.Join(dir, "c.yml"))
+		assert.NilError(err, "loading config with "+name, t)
+
+		var errs = initRules(rlist, l.transports, l.vars)
+		var found bool
+		for _, err := range errs {
+			found = found || strings.Contains(err.Error(), "continue rules can't")
+		}
+		assert.True(found, "continue rule with "+name+" is rejected", t)
+	}
+}
+
+func TestApplyArgs(t *testing.T) {
+	var saved = opts
+	defer func() { opts = saved }()
+
+	var tests = map[string]struct {
+		argv       []string
+		msg        string
+		sender     string
+		nullSender bool
+		rcpts      string
+		from       string
+		to         string
+		ignoreDots bool
+	}{
+		"args only": {
+			argv:   []string{"b@example.com"},
+			msg:    "From: me@example.com\nTo: a@example.com\n",
+			sender: "me@example.com",
+			rcpts:  "b@example.com",
+			from:   "me@example.com",
+			to:     "a@example.com",
+		},
+		"args set a missing To": {
+			argv:   []string{"b@example.com", "c@example.com"},
+			msg:    "From: me@example.com\n",
+			sender: "me@example.com",
+			rcpts:  "b@example.com,c@example.com",
+			from:   "me@example.com",
+			to:     "<b@example.com>,<c@example.com>",
+		},
+		"-t merges args without duplicates": {
+			argv:   []string{"-t", "b@example.com", "c@example.com"},
+			msg:    "From: me@example.com\nTo: a@example.com\nCc: B@example.com\n",
+			sender: "me@example.com",
+			rcpts:  "a@example.com,B@example.com,c@example.com",
+			from:   "me@example.com",
+			to:     "a@example.com",
+		},
+		"-f sets a missing From": {
+			argv:   []string{"-f", "bounce@example.com", "b@example.com"},
+			msg:    "To: a@example.com\n",
+			sender: "bounce@example.com",
+			rcpts:  "b@example.com",
+			from:   "<bounce@example.com>",
+			to:     "a@example.com",
+		},
+		"-r is -f": {
+			argv:   []string{"-r", "bounce@example.com", "b@example.com"},
+			msg:    "From: me@example.com\n",
+			sender: "bounce@example.com",
+			rcpts:  "b@example.com",
+			from:   "me@example.com",
+			to:     "<b@example.com>",
+		},
+		"-F renames the sender": {
+			argv:   []string{"-F", "Jo Smith", "b@example.com"},
+			msg:    "From: Someone <me@example.com>\n",
+			sender: "me@example.com",
+			rcpts:  "b@example.com",
+			from:   `"Jo Smith" <me@example.com>`,
+			to:     "<b@example.com>",
+		},
+		"-f <>": {
+			argv:       []string{"-f", "<>", "b@example.com"},
+			msg:        "From: me@example.com\n",
+			nullSender: true,
+			rcpts:      "b@example.com",
+			from:       "me@example.com",
+			to:         "<b@example.com>",
+		},
+		"empty -f": {
+			argv:       []string{"-f", "", "b@example.com"},
+			msg:        "From: me@example.com\n",
+			nullSender: true,
+			rcpts:      "b@example.com",
+			from:       "me@example.com",
+			to:         "<b@example.com>",
+		},
+		"empty -r": {
+			argv:       []string{"-r", "", "b@example.com"},
+			msg:        "From: me@example.com\n",
+			nullSender: true,
+			rcpts:      "b@example.com",
+			from:       "me@example.com",
+			to:         "<b@example.com>",
+		},
+		"-oi": {
+			argv:       []string{"-oi", "b@example.com"},
+			msg:        "From: me@example.com\n",
+			sender:     "me@example.com",
+			rcpts:      "b@example.com",
+			from:       "me@example.com",
+			to:         "<b@example.com>",
+			ignoreDots: true,
+		},
+	}
+
+	for name, tc := range tests {
+		opts = saved
+		var parser = flags.NewParser(&opts, flags.None)
+		parser.SubcommandsOptional = true
+		var args, err = parser.ParseArgs(tc.argv)
+		if err != nil {
+			t.Fatalf("%s: unable to parse %q: %s", name, tc.argv, err)
+		}
+		applyOptions(parser)
+
+		var e *email.Email
+		e, err = email.Read(strings.NewReader(tc.msg + "Subject: hi\n\nhi"))
+		if err != nil {
+			t.Fatalf("%s: couldn't read email: %s", name, err)
+		}
+		applyArgs(e, args)
+
+		var sender, _ = e.Sender()
+		var rcpts, _ = e.Recipients()
+		assert.Equal(tc.sender, sender, name+": envelope sender", t)
+		assert.Equal(tc.nullSender, e.Envelope.NullSender, name+": null sender", t)
+		assert.Equal(tc.rcpts, strings.Join(rcpts, ","), name+": envelope recipients", t)
+		assert.Equal(tc.from, e.Header.Get("from"), name+": From header", t)
+		assert.Equal(tc.to, e.Header.Get("to"), name+": To header", t)
+		assert.Equal(tc.ignoreDots, opts.IgnoreDots, name+": ignore dots", t)
+	}
+}
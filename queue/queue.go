@@ -0,0 +1,339 @@
+// Package queue implements an on-disk spool for messages which couldn't be
+// delivered right away.  Writes are maildir-style: files are written in the
+// spool's "tmp" directory and renamed into place, so readers never see a
+// partial message or metadata file.
+//
+// The spool has four subdirectories: "tmp" for in-progress writes, "msg" for
+// message data (in the same format email.Read parses), and "active" and "hold"
+// for each entry's JSON metadata.  A message is only considered queued once
+// its metadata file exists, and held messages aren't retried until they're
+// released.
+package queue
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/Nerdmaster/sendmail/email"
+)
+
+// Retry timing: the first retry happens after MinBackoff, and each later
+// retry waits twice as long as the one before, up to MaxBackoff
+const (
+	MinBackoff = 5 * time.Minute
+	MaxBackoff = 4 * time.Hour
+)
+
+// Entry is the metadata stored for each queued message
+type Entry struct {
+	ID         string
+	Created    time.Time
+	Sender     string
+	Recipients []string
+
+	// NullSender is set when the message has the null sender, so Sender being
+	// empty isn't mistaken for an unset sender
+	NullSender bool `json:",omitempty"`
+
+	// RuleID identifies the rule the message matched, so a retry goes through
+	// the same rule even if the config has been reordered since
+	RuleID string `json:",omitempty"`
+
+	Size        int
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+
+	// Captures holds the regex capture groups from the rule's matchers, which
+	// can decide the transport a retry is sent through
+	Captures map[string]string `json:",omitempty"`
+
+	// Held is set when the entry was read from the hold directory
+	Held bool `json:"-"`
+}
+
+// Backoff returns how long to wait before the next attempt after the given
+// number of failed attempts
+func Backoff(attempts int) time.Duration {
+	var d = MinBackoff
+	for i := 1; i < attempts && d < MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > MaxBackoff {
+		d = MaxBackoff
+	}
+	return d
+}
+
+// Failed records a failed delivery attempt, scheduling the next one
+func (en *Entry) Failed(err error) {
+	en.Attempts++
+	en.LastError = err.Error()
+	en.NextAttempt = time.Now().Add(Backoff(en.Attempts))
+}
+
+// Queue is a spool directory
+type Queue struct {
+	Dir string
+}
+
+// Open returns a Queue for the given directory, creating it and its
+// subdirectories if necessary
+func Open(dir string) (*Queue, error) {
+	var q = &Queue{Dir: dir}
+	for _, sub := range []string{"tmp", "msg", "active", "hold"} {
+		var err = os.MkdirAll(q.path(sub), 0700)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+func (q *Queue) path(parts ...string) string {
+	return filepath.Join(append([]string{q.Dir}, parts...)...)
+}
+
+// metaPath returns the path to the entry's metadata file
+func (q *Queue) metaPath(en *Entry) string {
+	if en.Held {
+		return q.path("hold", en.ID)
+	}
+	return q.path("active", en.ID)
+}
+
+func newID() (string, error) {
+	var b = make([]byte, 4)
+	var _, err = rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%012x%s", time.Now().UnixNano()/1000, hex.EncodeToString(b)), nil
+}
+
+// writeFile atomically writes data to the spool path given by parts
+func (q *Queue) writeFile(data []byte, parts ...string) error {
+	var f, err = ioutil.TempFile(q.path("tmp"), "write-")
+	if err != nil {
+		return err
+	}
+	var tmpname = f.Name()
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	var cerr = f.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpname, q.path(parts...))
+	}
+	if err != nil {
+		os.Remove(tmpname)
+	}
+	return err
+}
+
+// Add spools the message, recording the ID of the rule it matched, the rule's
+// regex captures, and the error which kept it from being delivered (nil if no
+// delivery was attempted)
+func (q *Queue) Add(e *email.Email, ruleID string, captures map[string]string, lastErr error) (*Entry, error) {
+	var id, err = newID()
+	if err != nil {
+		return nil, err
+	}
+
+	var en = &Entry{ID: id, Created: time.Now(), RuleID: ruleID, Captures: captures}
+	en.NullSender = e.Envelope.NullSender
+	en.Sender, err = e.Sender()
+	if err == nil {
+		en.Recipients, err = e.Recipients()
+	}
+	if err != nil {
+		return nil, err
+	}
+	en.NextAttempt = en.Created
+	if lastErr != nil {
+		en.Failed(lastErr)
+	}
+
+	var data = e.Bytes()
+	en.Size = len(data)
+	err = q.writeFile(data, "msg", id)
+	if err != nil {
+		return nil, err
+	}
+	err = q.Update(en)
+	if err != nil {
+		os.Remove(q.path("msg", id))
+		return nil, err
+	}
+
+	return en, nil
+}
+
+// Update atomically rewrites the entry's metadata
+func (q *Queue) Update(en *Entry) error {
+	var data, err = json.MarshalIndent(en, "", "  ")
+	if err != nil {
+		return err
+	}
+	if en.Held {
+		return q.writeFile(data, "hold", en.ID)
+	}
+	return q.writeFile(data, "active", en.ID)
+}
+
+// Entries returns all queued entries, including held entries, oldest first.
+// Entries which can't be read are logged and skipped, so one bad file doesn't
+// stop the rest of the queue from being processed.
+func (q *Queue) Entries() ([]*Entry, error) {
+	var list []*Entry
+	for _, sub := range []string{"active", "hold"} {
+		var infos, err = ioutil.ReadDir(q.path(sub))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, info := range infos {
+			var en *Entry
+			en, err = q.readEntry(sub, info.Name())
+			// An entry removed since the directory was read was just delivered
+			// or deleted by another process
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				log.Printf("queue: skipping entry %q: %s", info.Name(), err)
+				continue
+			}
+			list = append(list, en)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+
+	return list, nil
+}
+
+// Entry reads the metadata for the given queue ID, whether it's held or not
+func (q *Queue) Entry(id string) (*Entry, error) {
+	id = filepath.Base(id)
+	var en, err = q.readEntry("active", id)
+	if os.IsNotExist(err) {
+		en, err = q.readEntry("hold", id)
+	}
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no queue entry %q", id)
+	}
+	return en, err
+}
+
+func (q *Queue) readEntry(sub, id string) (*Entry, error) {
+	var data, err = ioutil.ReadFile(q.path(sub, id))
+	if err != nil {
+		return nil, err
+	}
+
+	var en = &Entry{Held: sub == "hold"}
+	err = json.Unmarshal(data, en)
+	if err != nil {
+		return nil, fmt.Errorf("invalid queue entry %q: %s", id, err)
+	}
+	return en, nil
+}
+
+// Hold moves the entry to the hold directory so it won't be retried
+func (q *Queue) Hold(en *Entry) error {
+	if en.Held {
+		return nil
+	}
+	var err = os.Rename(q.path("active", en.ID), q.path("hold", en.ID))
+	if err == nil {
+		en.Held = true
+	}
+	return err
+}
+
+// Release moves a held entry back into the active queue, due for a retry
+// right away
+func (q *Queue) Release(en *Entry) error {
+	if !en.Held {
+		return nil
+	}
+	en.NextAttempt = time.Now()
+	var err = q.Update(en)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(q.path("hold", en.ID), q.path("active", en.ID))
+	if err == nil {
+		en.Held = false
+	}
+	return err
+}
+
+// Raw returns the entry's message data exactly as it was spooled
+func (q *Queue) Raw(en *Entry) ([]byte, error) {
+	return ioutil.ReadFile(q.path("msg", en.ID))
+}
+
+// Message reads the queued message for the entry, with its envelope set from
+// the entry's metadata
+func (q *Queue) Message(en *Entry) (*email.Email, error) {
+	var f, err = os.Open(q.path("msg", en.ID))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var e *email.Email
+	e, err = email.ReadIgnoringDots(f)
+	if err != nil {
+		return nil, err
+	}
+	e.Envelope.From = en.Sender
+	e.Envelope.To = en.Recipients
+	e.Envelope.NullSender = en.NullSender && en.Sender == ""
+	return e, nil
+}
+
+// Remove deletes the entry's metadata and message from the spool
+func (q *Queue) Remove(en *Entry) error {
+	var err = os.Remove(q.metaPath(en))
+	if err != nil {
+		return err
+	}
+	return os.Remove(q.path("msg", en.ID))
+}
+
+// Lock takes an exclusive lock on the spool so only one queue runner can
+// process it at a time.  The returned function releases the lock.
+func (q *Queue) Lock() (unlock func(), err error) {
+	var f *os.File
+	f, err = os.OpenFile(q.path("lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("queue %q is locked by another process", q.Dir)
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
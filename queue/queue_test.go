@@ -0,0 +1,161 @@
+package queue
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Nerdmaster/sendmail/email"
+	"github.com/uoregon-libraries/gopkg/assert"
+)
+
+func mkqueue(t *testing.T) *Queue {
+	var dir, err = ioutil.TempDir("", "go-sendmail-queue-")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	var q *Queue
+	q, err = Open(dir)
+	if err != nil {
+		t.Fatalf("Unable to open queue: %s", err)
+	}
+	return q
+}
+
+func TestBackoff(t *testing.T) {
+	assert.Equal(MinBackoff, Backoff(1), "first retry", t)
+	assert.Equal(MinBackoff*2, Backoff(2), "second retry", t)
+	assert.Equal(MinBackoff*8, Backoff(4), "fourth retry", t)
+	assert.Equal(MaxBackoff, Backoff(100), "retries are capped", t)
+}
+
+func TestAddAndRead(t *testing.T) {
+	var q = mkqueue(t)
+	var e, err = email.ReadIgnoringDots(bytes.NewBufferString("Subject: hi\nFrom: me@example.org\n" +
+		"To: you@example.org\nBcc: secret@example.org\n\nline one\r\n.\r\nline two"))
+	if err != nil {
+		t.Fatalf("Couldn't read email: %s", err)
+	}
+
+	var en *Entry
+	en, err = q.Add(e, "contact-form", map[string]string{"1": "you", "user": "you"}, errors.New("421 try later"))
+	assert.NilError(err, "adding to queue", t)
+	assert.Equal("me@example.org", en.Sender, "sender", t)
+	assert.Equal(2, len(en.Recipients), "recipients include bcc", t)
+	assert.Equal(1, en.Attempts, "attempts", t)
+	assert.True(en.NextAttempt.After(time.Now()), "next attempt is in the future", t)
+
+	var list []*Entry
+	list, err = q.Entries()
+	assert.NilError(err, "listing queue", t)
+	assert.Equal(1, len(list), "queue size", t)
+	assert.Equal(en.ID, list[0].ID, "queue ID", t)
+	assert.Equal("421 try later", list[0].LastError, "last error", t)
+	assert.Equal("contact-form", list[0].RuleID, "rule", t)
+	assert.Equal("you", list[0].Captures["user"], "captures", t)
+
+	var e2 *email.Email
+	e2, err = q.Message(list[0])
+	assert.NilError(err, "reading queued message", t)
+	assert.Equal(string(e.Message), string(e2.Message), "message body survives a lone dot", t)
+	assert.Equal("hi", e2.Header.Get("subject"), "subject", t)
+	assert.Equal("secret@example.org", e2.Envelope.To[1], "envelope is restored", t)
+
+	assert.NilError(q.Remove(list[0]), "removing entry", t)
+	list, err = q.Entries()
+	assert.NilError(err, "listing queue", t)
+	assert.Equal(0, len(list), "queue size after removal", t)
+}
+
+func TestNullSender(t *testing.T) {
+	var q = mkqueue(t)
+	var e, err = email.ReadIgnoringDots(bytes.NewBufferString("Subject: bounce\nFrom: mailer-daemon@example.org\n" +
+		"To: you@example.org\n\nundeliverable"))
+	if err != nil {
+		t.Fatalf("Couldn't read email: %s", err)
+	}
+	e.Envelope.NullSender = true
+
+	var en *Entry
+	en, err = q.Add(e, "bounces", nil, nil)
+	assert.NilError(err, "adding to queue", t)
+	assert.Equal("", en.Sender, "sender", t)
+
+	var list, _ = q.Entries()
+	var e2 *email.Email
+	e2, err = q.Message(list[0])
+	assert.NilError(err, "reading queued message", t)
+	var from, _ = e2.Sender()
+	assert.Equal("", from, "null sender is restored", t)
+}
+
+func TestHoldRelease(t *testing.T) {
+	var q = mkqueue(t)
+	var e, err = email.Read(bytes.NewBufferString("From: me@example.org\nTo: you@example.org\n\nhi"))
+	if err != nil {
+		t.Fatalf("Couldn't read email: %s", err)
+	}
+
+	var en *Entry
+	en, err = q.Add(e, "", nil, errors.New("421 try later"))
+	assert.NilError(err, "adding to queue", t)
+	assert.NilError(q.Hold(en), "holding entry", t)
+
+	var held *Entry
+	held, err = q.Entry(en.ID)
+	assert.NilError(err, "reading held entry", t)
+	assert.True(held.Held, "entry is held", t)
+
+	var raw []byte
+	raw, err = q.Raw(held)
+	assert.NilError(err, "reading raw message", t)
+	assert.Equal("From: me@example.org\r\nTo: you@example.org\r\n\r\nhi", string(raw), "raw message", t)
+
+	assert.NilError(q.Release(held), "releasing entry", t)
+	var released *Entry
+	released, err = q.Entry(en.ID)
+	assert.NilError(err, "reading released entry", t)
+	assert.False(released.Held, "entry is no longer held", t)
+	assert.False(released.NextAttempt.After(time.Now()), "released entry is due", t)
+
+	_, err = q.Entry("nope")
+	assert.True(err != nil, "missing entries are errors", t)
+}
+
+func TestLock(t *testing.T) {
+	var q = mkqueue(t)
+	var unlock, err = q.Lock()
+	assert.NilError(err, "first lock", t)
+
+	_, err = q.Lock()
+	assert.True(err != nil, "second lock should fail", t)
+
+	unlock()
+	unlock, err = q.Lock()
+	assert.NilError(err, "lock after unlock", t)
+	unlock()
+}
+
+func TestEntriesSkipsBadFiles(t *testing.T) {
+	var q = mkqueue(t)
+	var e, err = email.Read(bytes.NewBufferString("From: me@example.org\nTo: you@example.org\n\nhi"))
+	if err != nil {
+		t.Fatalf("Couldn't read email: %s", err)
+	}
+	_, err = q.Add(e, "", nil, nil)
+	assert.NilError(err, "adding to queue", t)
+
+	err = ioutil.WriteFile(q.path("active", "garbage"), []byte("{not json"), 0600)
+	assert.NilError(err, "writing a bad entry", t)
+
+	var list []*Entry
+	list, err = q.Entries()
+	assert.NilError(err, "listing queue", t)
+	assert.Equal(1, len(list), "the bad entry is skipped", t)
+}
@@ -1,8 +1,9 @@
 package rule
 
 import (
-	"bytes"
 	"errors"
+	"fmt"
+	"regexp"
 	"strings"
 	"text/template"
 
@@ -10,25 +11,96 @@ import (
 )
 
 type action interface {
-	apply(e *email.Email)
+	apply(e *email.Email, r *Rule, caps Captures) error
+}
+
+// actionParsers maps each action command to the function which parses its
+// arguments
+var actionParsers = map[string]func(string) (action, error){
+	"SetHeader":          newActSetHeader,
+	"SetHeaderIfMissing": newActSetHeaderIfMissing,
+	"AddHeader":          newActAddHeader,
+	"DelHeader":          newActDelHeader,
+	"RenameHeader":       newActRenameHeader,
+	"SetEnvelopeFrom":    newActSetEnvelopeFrom,
+
+	"Redirect":              envelopeOnly(newActRedirect),
+	"Redirect/headers":      withHeaders(newActRedirect),
+	"AddRecipient":          envelopeOnly(newActAddRecipient),
+	"AddRecipient/headers":  withHeaders(newActAddRecipient),
+	"AlwaysBcc":             newActAlwaysBcc,
+	"DropRecipient":         envelopeOnly(newActDropRecipient),
+	"DropRecipient/headers": withHeaders(newActDropRecipient),
+	"RewriteDomain":         envelopeOnly(newActRewriteDomain),
+	"RewriteDomain/headers": withHeaders(newActRewriteDomain),
+
+	"Discard": newActDiscard,
+	"Reject":  newActReject,
+	"Defer":   newActDefer,
+}
+
+// envelopeOnly and withHeaders adapt a recipient action's parser for the
+// plain and "/headers" forms of its command
+func envelopeOnly(parse func(string, bool) (action, error)) func(string) (action, error) {
+	return func(data string) (action, error) { return parse(data, false) }
+}
+
+func withHeaders(parse func(string, bool) (action, error)) func(string) (action, error) {
+	return func(data string) (action, error) { return parse(data, true) }
 }
 
 // AddAction parses the string and puts the parsed action into the Rule's
-// actions list.  If parsing fails, an error is returned.
+// actions list.  If parsing fails, an error is returned.  A terminal action
+// (Discard, Reject, or Defer) must be the rule's last action.
 func (r *Rule) AddAction(astr string) error {
 	var parts = strings.SplitN(astr, " ", 2)
-	if len(parts) != 2 {
+	if parts[0] == "" {
 		return errors.New("invalid action syntax")
 	}
-	switch parts[0] {
-	case "SetHeader":
-		var a, err = newActSetHeader(parts[1])
-		if err == nil {
-			r.actions = append(r.actions, a)
-		}
+	var parse, ok = actionParsers[parts[0]]
+	if !ok {
+		return errors.New("unknown action command: " + parts[0])
+	}
+	if r.terminal != nil {
+		return fmt.Errorf("no actions may follow %s", r.terminal.cmd)
+	}
+
+	var data string
+	if len(parts) == 2 {
+		data = parts[1]
+	}
+	var a, err = parse(data)
+	if err != nil {
 		return err
 	}
-	return errors.New("unknown action command: " + parts[0])
+	r.actions = append(r.actions, a)
+	if t, isTerminal := a.(*actTerminal); isTerminal {
+		r.terminal = t
+	}
+	return nil
+}
+
+// validField returns an error if name can't be used as a header field name
+func validField(cmd, name string) error {
+	if name == "" || strings.ContainsAny(name, ": \t") {
+		return fmt.Errorf("invalid %s syntax: bad field name %q", cmd, name)
+	}
+	return nil
+}
+
+// parseFieldTemplate splits "Field:template" arguments
+func parseFieldTemplate(cmd, data string) (string, *template.Template, error) {
+	var parts = strings.SplitN(data, ":", 2)
+	if len(parts) != 2 {
+		return "", nil, fmt.Errorf("invalid %s syntax: missing new value", cmd)
+	}
+	var err = validField(cmd, parts[0])
+	if err != nil {
+		return "", nil, err
+	}
+	var tmpl *template.Template
+	tmpl, err = newTemplate(cmd, parts[1])
+	return parts[0], tmpl, err
 }
 
 type actSetHeader struct {
@@ -36,23 +108,205 @@ type actSetHeader struct {
 	tmpl  *template.Template
 }
 
-func newActSetHeader(data string) (*actSetHeader, error) {
+func newActSetHeader(data string) (action, error) {
+	var field, tmpl, err = parseFieldTemplate("SetHeader", data)
+	if err != nil {
+		return nil, err
+	}
+	return &actSetHeader{field: field, tmpl: tmpl}, nil
+}
+
+func (a *actSetHeader) apply(e *email.Email, r *Rule, caps Captures) error {
+	e.Header.Set(a.field, render(a.tmpl, e, r, caps))
+	return nil
+}
+
+// actSetHeaderIfMissing works like SetHeader, but leaves the field alone if
+// it's already present
+type actSetHeaderIfMissing struct {
+	field string
+	tmpl  *template.Template
+}
+
+func newActSetHeaderIfMissing(data string) (action, error) {
+	var field, tmpl, err = parseFieldTemplate("SetHeaderIfMissing", data)
+	if err != nil {
+		return nil, err
+	}
+	return &actSetHeaderIfMissing{field: field, tmpl: tmpl}, nil
+}
+
+func (a *actSetHeaderIfMissing) apply(e *email.Email, r *Rule, caps Captures) error {
+	if e.Header.Values(a.field) == nil {
+		e.Header.Set(a.field, render(a.tmpl, e, r, caps))
+	}
+	return nil
+}
+
+// actAddHeader appends a value to a field, keeping any existing values
+type actAddHeader struct {
+	field string
+	tmpl  *template.Template
+}
+
+func newActAddHeader(data string) (action, error) {
+	var field, tmpl, err = parseFieldTemplate("AddHeader", data)
+	if err != nil {
+		return nil, err
+	}
+	return &actAddHeader{field: field, tmpl: tmpl}, nil
+}
+
+func (a *actAddHeader) apply(e *email.Email, r *Rule, caps Captures) error {
+	e.Header.Add(a.field, render(a.tmpl, e, r, caps))
+	return nil
+}
+
+// actDelHeader removes a field, or every field whose name matches a regex
+// when the name is written as "/regex/".  Regexes are case-insensitive, as
+// field names are.
+type actDelHeader struct {
+	field string
+	re    *regexp.Regexp
+}
+
+func newActDelHeader(data string) (action, error) {
+	data = strings.TrimSpace(data)
+	if len(data) > 1 && strings.HasPrefix(data, "/") && strings.HasSuffix(data, "/") {
+		var re, err = regexp.Compile("(?i)" + data[1:len(data)-1])
+		if err != nil {
+			return nil, errors.New("invalid DelHeader syntax: " + err.Error())
+		}
+		return &actDelHeader{re: re}, nil
+	}
+
+	var err = validField("DelHeader", data)
+	if err != nil {
+		return nil, err
+	}
+	return &actDelHeader{field: data}, nil
+}
+
+func (a *actDelHeader) apply(e *email.Email, r *Rule, caps Captures) error {
+	if a.re == nil {
+		e.Header.Del(a.field)
+		return nil
+	}
+	for _, field := range e.Header.Fields() {
+		if a.re.MatchString(field) {
+			e.Header.Del(field)
+		}
+	}
+	return nil
+}
+
+// actRenameHeader moves every value of one field to another, replacing
+// anything already in the new field
+type actRenameHeader struct {
+	from string
+	to   string
+}
+
+func newActRenameHeader(data string) (action, error) {
 	var parts = strings.SplitN(data, ":", 2)
 	if len(parts) != 2 {
-		return nil, errors.New("invalid SetHeader syntax: missing new value")
+		return nil, errors.New("invalid RenameHeader syntax: must be Old:New")
+	}
+	for _, name := range parts {
+		var err = validField("RenameHeader", name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &actRenameHeader{from: parts[0], to: parts[1]}, nil
+}
+
+func (a *actRenameHeader) apply(e *email.Email, r *Rule, caps Captures) error {
+	var vals = e.Header.Values(a.from)
+	if vals == nil {
+		return nil
 	}
-	var a = &actSetHeader{field: parts[0]}
-	a.tmpl = template.New("tmpl")
-	var _, err = a.tmpl.Parse(parts[1])
+	vals = append([]string(nil), vals...)
+	e.Header.Del(a.from)
+	e.Header.Del(a.to)
+	for _, v := range vals {
+		e.Header.Add(a.to, v)
+	}
+	return nil
+}
+
+type actSetEnvelopeFrom struct {
+	tmpl *template.Template
+}
+
+func newActSetEnvelopeFrom(data string) (action, error) {
+	var tmpl, err = newTemplate("SetEnvelopeFrom", data)
 	if err != nil {
-		return nil, errors.New("invalid SetHeader syntax: " + err.Error())
+		return nil, err
+	}
+	return &actSetEnvelopeFrom{tmpl: tmpl}, nil
+}
+
+func (a *actSetEnvelopeFrom) apply(e *email.Email, r *Rule, caps Captures) error {
+	e.Envelope.From = render(a.tmpl, e, r, caps)
+	return nil
+}
+
+// Disposition says what happens to a message once a rule's actions have run
+type Disposition int
+
+// The possible dispositions: by default the message is delivered, but a
+// terminal action can discard it, reject it, or defer it to the queue
+const (
+	Deliver Disposition = iota
+	Discard
+	Reject
+	Defer
+)
+
+// actTerminal is a Discard, Reject, or Defer action.  It doesn't change the
+// email; the rule reports it via Disposition.
+type actTerminal struct {
+	cmd         string
+	disposition Disposition
+	reason      string
+}
+
+func (a *actTerminal) apply(e *email.Email, r *Rule, caps Captures) error {
+	return nil
+}
+
+func newActDiscard(data string) (action, error) {
+	if strings.TrimSpace(data) != "" {
+		return nil, errors.New("invalid Discard syntax: Discard takes no arguments")
+	}
+	return &actTerminal{cmd: "Discard", disposition: Discard}, nil
+}
+
+func newActDefer(data string) (action, error) {
+	if strings.TrimSpace(data) != "" {
+		return nil, errors.New("invalid Defer syntax: Defer takes no arguments")
 	}
+	return &actTerminal{cmd: "Defer", disposition: Defer}, nil
+}
 
-	return a, nil
+// newActReject parses Reject's optional reason, which may be quoted
+func newActReject(data string) (action, error) {
+	var reason = strings.TrimSpace(data)
+	if len(reason) >= 2 && reason[0] == '"' && reason[len(reason)-1] == '"' {
+		reason = reason[1 : len(reason)-1]
+	}
+	if reason == "" {
+		reason = "Message rejected"
+	}
+	return &actTerminal{cmd: "Reject", disposition: Reject, reason: reason}, nil
 }
 
-func (a *actSetHeader) apply(e *email.Email) {
-	var b bytes.Buffer
-	a.tmpl.Execute(&b, e.Header)
-	e.Header.Set(a.field, b.String())
+// Disposition returns what should happen to a message after the rule's
+// actions are applied, and for Reject, the reason to give
+func (r *Rule) Disposition() (d Disposition, reason string) {
+	if r.terminal == nil {
+		return Deliver, ""
+	}
+	return r.terminal.disposition, r.terminal.reason
 }
@@ -35,3 +35,89 @@ func TestRuleActionSetHeader(t *testing.T) {
 	assert.Equal("Reply-To: --somebody@example.com--", lines[2], "header line 2", t)
 	assert.Equal("To: foo@example.com,Mister F. <tobias.f@example.com>", lines[3], "header line 3", t)
 }
+
+func TestRuleActionSetEnvelopeFrom(t *testing.T) {
+	var e = email.New()
+	e.Header.Set("from", "somebody@example.com")
+	e.Header.Set("x-list", "announce")
+
+	var r = mkActRule(t, `SetEnvelopeFrom {{.Get "x-list"}}-bounces@example.com`)
+	r.Apply(e)
+	assert.Equal("announce-bounces@example.com", e.Envelope.From, "envelope from", t)
+	assert.Equal("somebody@example.com", e.Header.Get("from"), "from header", t)
+}
+
+func TestRuleActionHeaderEdits(t *testing.T) {
+	var e, err = email.Read(strings.NewReader("From: me@example.org\nX-PHP-Originating-Script: 1000:mail.php\n" +
+		"X-Php-Script: /var/www/index.php\nX-Tag: one\nX-Old: a\nX-Old: b\nX-New: gone\n\nhi"))
+	if err != nil {
+		t.Fatalf("Couldn't read email: %s", err)
+	}
+
+	var r = mkActRule(t,
+		"AddHeader X-Tag:two",
+		"DelHeader /^X-PHP-/",
+		"RenameHeader X-Old:X-New",
+		"SetHeaderIfMissing X-Tag:ignored",
+		`SetHeaderIfMissing Reply-To:{{.Get "from"}}`,
+		"DelHeader X-Nope",
+	)
+	r.Apply(e)
+
+	var b bytes.Buffer
+	e.Header.Write(&b)
+	assert.Equal("From: me@example.org\r\nReply-To: me@example.org\r\nX-New: a\r\nX-New: b\r\nX-Tag: one\r\nX-Tag: two",
+		b.String(), "edited header", t)
+}
+
+func TestRuleActionSyntax(t *testing.T) {
+	var bad = []string{
+		"AddHeader X-Tag",
+		"AddHeader Bad Name:x",
+		"DelHeader /(/",
+		"DelHeader X:Y",
+		"RenameHeader X-Old",
+		"RenameHeader :X-New",
+		"SetHeaderIfMissing X-Tag:{{",
+		"Explode now",
+	}
+	for _, astr := range bad {
+		var err = (&Rule{}).AddAction(astr)
+		if err == nil {
+			t.Errorf("%q should be an invalid action", astr)
+		}
+	}
+}
+
+func TestRuleActionTerminal(t *testing.T) {
+	var r = &Rule{}
+	var d, reason = r.Disposition()
+	assert.Equal(Deliver, d, "rules deliver by default", t)
+
+	assert.NilError(r.AddAction("SetHeader X-Tag:cron"), "adding SetHeader", t)
+	assert.NilError(r.AddAction(`Reject "No cron mail, please"`), "adding Reject", t)
+	d, reason = r.Disposition()
+	assert.Equal(Reject, d, "disposition", t)
+	assert.Equal("No cron mail, please", reason, "quotes are stripped from the reason", t)
+	assert.True(r.AddAction("SetHeader X-Late:1") != nil, "actions can't follow Reject", t)
+	assert.True(r.AddAction("Discard") != nil, "only one terminal action", t)
+
+	r = &Rule{}
+	assert.NilError(r.AddAction("Reject"), "adding Reject with no reason", t)
+	d, reason = r.Disposition()
+	assert.Equal("Message rejected", reason, "default reason", t)
+
+	r = &Rule{}
+	assert.NilError(r.AddAction("Discard"), "adding Discard", t)
+	d, _ = r.Disposition()
+	assert.Equal(Discard, d, "discard disposition", t)
+
+	r = &Rule{}
+	assert.NilError(r.AddAction("Defer"), "adding Defer", t)
+	d, _ = r.Disposition()
+	assert.Equal(Defer, d, "defer disposition", t)
+
+	assert.True((&Rule{}).AddAction("Discard now") != nil, "Discard takes no arguments", t)
+	assert.True((&Rule{}).AddAction("Defer 5m") != nil, "Defer takes no arguments", t)
+	assert.True((&Rule{}).AddAction("SetHeader") != nil, "SetHeader still needs arguments", t)
+}
@@ -0,0 +1,63 @@
+package rule
+
+import (
+	"regexp"
+	"strconv"
+)
+
+// Captures holds the capture groups of a rule's regex matchers, keyed by
+// number and, for named groups, by name as well.  Numbers count up across
+// every regex matcher which matched, in order, so with the matchers
+// "To/regex:^(\w+)@" and "Subject/regex:^\[(?P<tag>\w+)\]", "1" is the
+// recipient's user name and "2" (also "tag") is the subject's tag.  Negated
+// matchers and members of a "not" group don't capture anything, and an "any"
+// group only captures from the member which matched.
+type Captures map[string]string
+
+// add records the submatches of a regex match
+func (c Captures) add(re *regexp.Regexp, submatches []string) {
+	if submatches == nil {
+		return
+	}
+
+	var n = c.numbered()
+	for i, name := range re.SubexpNames() {
+		if i == 0 {
+			continue
+		}
+		n++
+		c[strconv.Itoa(n)] = submatches[i]
+		if name != "" {
+			c[name] = submatches[i]
+		}
+	}
+}
+
+// numbered returns how many numbered captures have been recorded
+func (c Captures) numbered() int {
+	var n int
+	for n = 0; ; n++ {
+		var _, ok = c[strconv.Itoa(n+1)]
+		if !ok {
+			return n
+		}
+	}
+}
+
+func (c Captures) clone() Captures {
+	if c == nil {
+		return nil
+	}
+	var c2 = make(Captures, len(c))
+	c2.merge(c)
+	return c2
+}
+
+func (c Captures) merge(other Captures) {
+	if c == nil {
+		return
+	}
+	for k, v := range other {
+		c[k] = v
+	}
+}
@@ -0,0 +1,67 @@
+package rule
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Nerdmaster/sendmail/email"
+	"github.com/uoregon-libraries/gopkg/assert"
+)
+
+func TestCaptures(t *testing.T) {
+	var e, err = email.Read(strings.NewReader("From: me@example.org\nTo: Jo <jo+billing@example.com>\n" +
+		"Subject: [urgent] hi\n\nhi"))
+	if err != nil {
+		t.Fatalf("Couldn't read email: %s", err)
+	}
+
+	var r = &Rule{}
+	assert.NilError(r.AddMatcher(`To/regex:^(\w+)\+(?P<dept>\w+)@example\.com$`), "adding To matcher", t)
+	assert.NilError(r.AddMatcher(`Subject/regex:^\[(?P<tag>\w+)\]`), "adding Subject matcher", t)
+	assert.NilError(r.AddMatcher(`!From/regex:^(nobody)@`), "adding negated matcher", t)
+	var g, _ = r.AddGroup(Any)
+	assert.NilError(g.AddMatcher(`Subject/regex:^(nope)`), "adding first any matcher", t)
+	assert.NilError(g.AddMatcher(`From/regex:@(.+)$`), "adding second any matcher", t)
+
+	var matched, caps = r.MatchCaptures(e)
+	assert.True(matched, "rule matches", t)
+	var expected = Captures{"1": "jo", "2": "billing", "dept": "billing", "3": "urgent", "tag": "urgent", "4": "example.org"}
+	assert.Equal(len(expected), len(caps), "number of captures", t)
+	for k, v := range expected {
+		assert.Equal(v, caps[k], "capture "+k, t)
+	}
+
+	var r2 = mkActRule(t, `SetHeader X-Dept:{{.Captures.dept}}`, `SetHeader X-User:{{index .Captures "1"}}`)
+	r2.ApplyCaptures(e, caps)
+	assert.Equal("billing", e.Header.Get("x-dept"), "named capture in a template", t)
+	assert.Equal("jo", e.Header.Get("x-user"), "numbered capture in a template", t)
+
+	r = &Rule{}
+	assert.NilError(r.AddMatcher(`Subject/regex:^(\w+)`), "adding matcher", t)
+	matched, caps = r.MatchCaptures(e)
+	assert.False(matched, "rule doesn't match", t)
+	assert.Equal(0, len(caps), "no captures without a match", t)
+}
+
+func TestCaptureLineBreaks(t *testing.T) {
+	var e, err = email.Read(strings.NewReader("From: me@example.org\nTo: you@example.org\n\n" +
+		"Name: Bob\r\nX-Evil: injected;\n"))
+	if err != nil {
+		t.Fatalf("Couldn't read email: %s", err)
+	}
+
+	var r = mkActRule(t, `SetHeader X-Name:{{index .Captures "1"}}`, `AddHeader X-Added:{{index .Captures "1"}}`,
+		`SetEnvelopeFrom {{index .Captures "1"}}`)
+	assert.NilError(r.AddMatcher(`body/regex:(?s)Name: ([^;]*);`), "adding body matcher", t)
+	var matched, caps = r.MatchCaptures(e)
+	assert.True(matched, "rule matches", t)
+	assert.True(strings.Contains(caps["1"], "\n"), "capture has a line break", t)
+
+	assert.NilError(r.ApplyCaptures(e, caps), "applying actions", t)
+	assert.Equal("Bob X-Evil: injected", e.Header.Get("x-name"), "SetHeader value is one line", t)
+	assert.Equal("Bob X-Evil: injected", e.Header.Get("x-added"), "AddHeader value is one line", t)
+	assert.Equal("Bob X-Evil: injected", e.Envelope.From, "envelope sender is one line", t)
+	assert.Equal("", e.Header.Get("x-evil"), "no header was injected", t)
+	var header = strings.SplitN(string(e.Bytes()), "\r\n\r\n", 2)[0]
+	assert.False(strings.Contains(header, "\nX-Evil"), "no header line was injected: "+header, t)
+}
@@ -0,0 +1,504 @@
+package rule
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Nerdmaster/sendmail/email"
+)
+
+// MaxAddresses is the most addresses or values a quantified matcher (e.g.,
+// "To/any" or "rcpt") will look at, so huge Cc lists stay cheap to match.
+// "any" matchers ignore values past the limit, and "all" matchers never match
+// a list longer than this.
+const MaxAddresses = 100
+
+// Address quantifiers
+const (
+	quantAny = "any"
+	quantAll = "all"
+)
+
+// addressFields are the header fields matched by their address rather than
+// their raw value
+var addressFields = map[string]bool{"to": true, "from": true, "cc": true, "bcc": true, "reply-to": true}
+
+// Pseudo-fields, which match something other than a header field
+const (
+	// rcptField is every recipient: the envelope recipients and the addresses
+	// in To, Cc, and Bcc
+	rcptField = "rcpt"
+
+	// bodyField is the decoded text of the message's non-attachment text parts
+	bodyField = "body"
+
+	// sizeOverField and sizeUnderField compare the message's size against the
+	// matcher's value, which can have a unit (e.g., "10M")
+	sizeOverField  = "size>"
+	sizeUnderField = "size<"
+
+	// attachmentField is "yes" if the message has any attachments, otherwise
+	// "no"
+	attachmentField = "attachment"
+
+	// partTypeField is the media type of each MIME part, and filenameField is
+	// each attachment's file name
+	partTypeField = "part-type"
+	filenameField = "filename"
+)
+
+// pseudoFields are the fields which aren't header fields
+var pseudoFields = map[string]bool{
+	rcptField: true, bodyField: true, sizeOverField: true, sizeUnderField: true,
+	attachmentField: true, partTypeField: true, filenameField: true,
+}
+
+// Presence checks: whether a header field is there at all, regardless of
+// its value
+const (
+	presenceExists  = "exists"
+	presenceMissing = "missing"
+)
+
+// listFields are pseudo-fields with multiple values.  They match if any value
+// matches, unless "/all" is used.
+var listFields = map[string]bool{rcptField: true, partTypeField: true, filenameField: true}
+
+// sizeUnits maps size suffixes to their multipliers
+var sizeUnits = map[string]int64{
+	"":   1,
+	"b":  1,
+	"k":  1 << 10,
+	"kb": 1 << 10,
+	"m":  1 << 20,
+	"mb": 1 << 20,
+	"g":  1 << 30,
+	"gb": 1 << 30,
+}
+
+// parseSize parses a size like "512", "100k", or "10MB".  Units are
+// case-insensitive and powers of 1024.
+func parseSize(s string) (int64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	var i = strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	if i < 0 {
+		i = len(s)
+	}
+	var mult, ok = sizeUnits[strings.TrimSpace(s[i:])]
+	var n, err = strconv.ParseInt(s[:i], 10, 64)
+	if !ok || err != nil {
+		return 0, fmt.Errorf("sendmail/filter: invalid size %q", s)
+	}
+	if n > math.MaxInt64/mult {
+		return 0, fmt.Errorf("sendmail/filter: size %q is too large", s)
+	}
+	return n * mult, nil
+}
+
+// Match modes: how a matcher's value is compared to the email's.  The
+// default is an exact match.
+const (
+	modeRegex  = "regex"
+	modeGlob   = "glob"
+	modeDomain = "domain"
+	modePrefix = "prefix"
+	modeSuffix = "suffix"
+)
+
+// globRegexp converts a shell-style wildcard pattern to a regular expression
+// matching the whole string: "*" is any run of characters, "?" is any single
+// character, and "[...]" is a character class.
+func globRegexp(pattern string, fold bool) (*regexp.Regexp, error) {
+	var b strings.Builder
+	if fold {
+		b.WriteString("(?i)")
+	}
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '[':
+			var end = strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("sendmail/filter: unclosed \"[\" in glob %q", pattern)
+			}
+			var class = pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// validDomain returns an error if d doesn't look like a domain, optionally
+// with a leading dot
+func validDomain(d string) error {
+	var name = strings.TrimPrefix(d, ".")
+	if name == "" || strings.ContainsAny(name, "@ \t") || strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".") {
+		return fmt.Errorf("sendmail/filter: invalid domain %q", d)
+	}
+	return nil
+}
+
+// matchDomain returns true if val's domain (the part after the last "@", or
+// all of val if there's no "@") is domain.  A leading dot on domain also
+// matches any subdomain of it.  Domains are compared case-insensitively.
+func matchDomain(domain, val string) bool {
+	var d = strings.ToLower(val)
+	var at = strings.LastIndex(d, "@")
+	if at >= 0 {
+		d = d[at+1:]
+	}
+	if strings.HasPrefix(domain, ".") {
+		return d == domain[1:] || strings.HasSuffix(d, domain)
+	}
+	return d == domain
+}
+
+// yesNo normalizes a yes/no matcher value
+func yesNo(s string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "yes", "true":
+		return "yes", nil
+	case "no", "false":
+		return "no", nil
+	}
+	return "", fmt.Errorf(`sendmail/filter: value must be "yes" or "no", not %q`, s)
+}
+
+type matcher struct {
+	condition  string
+	field      string
+	value      string
+	catchall   bool
+	negate     bool
+	quantifier string
+	mode       string
+	fold       bool
+	presence   string
+	re         *regexp.Regexp
+	size       int64
+}
+
+func newMatcher(condition string) (*matcher, error) {
+	var negate = strings.HasPrefix(condition, "!")
+	var m, err = parseMatcher(strings.TrimPrefix(condition, "!"))
+	if err != nil {
+		return nil, err
+	}
+	m.condition = condition
+	m.negate = negate
+	return m, nil
+}
+
+func parseMatcher(condition string) (*matcher, error) {
+	if condition == "*" {
+		return &matcher{catchall: true}, nil
+	}
+
+	var parts = strings.SplitN(condition, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("sendmail/filter: match condition format must have a colon")
+	}
+
+	var mods = strings.Split(strings.ToLower(parts[0]), "/")
+	var m = &matcher{field: mods[0], value: parts[1]}
+	for _, mod := range mods[1:] {
+		var err = m.addModifier(mod)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if m.presence != "" {
+		switch {
+		case len(mods) > 2:
+			return nil, fmt.Errorf("sendmail/filter: /%s can't be combined with other modifiers", m.presence)
+		case pseudoFields[m.field]:
+			return nil, fmt.Errorf("sendmail/filter: /%s only works on header fields", m.presence)
+		case m.value != "":
+			return nil, fmt.Errorf("sendmail/filter: /%s doesn't take a value", m.presence)
+		}
+		return m, nil
+	}
+
+	if m.quantifier != "" && pseudoFields[m.field] && !listFields[m.field] {
+		return nil, fmt.Errorf("sendmail/filter: /%s only works on header fields, %q, %q, and %q",
+			m.quantifier, rcptField, partTypeField, filenameField)
+	}
+	if listFields[m.field] && m.quantifier == "" {
+		m.quantifier = quantAny
+	}
+
+	var err error
+	switch m.field {
+	case sizeOverField, sizeUnderField, attachmentField:
+		if len(mods) > 1 {
+			return nil, fmt.Errorf("sendmail/filter: %q doesn't take modifiers", m.field)
+		}
+		if m.field == attachmentField {
+			m.value, err = yesNo(m.value)
+		} else {
+			m.size, err = parseSize(m.value)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch m.mode {
+	case modeRegex:
+		var pattern = m.value
+		if m.fold {
+			pattern = "(?i)" + pattern
+		}
+		m.re, err = regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("sendmail/filter: invalid match condition regex: %s", err)
+		}
+	case modeGlob:
+		m.re, err = globRegexp(m.value, m.fold)
+		if err != nil {
+			return nil, fmt.Errorf("sendmail/filter: invalid match condition glob: %s", err)
+		}
+	case modeDomain:
+		m.value = strings.ToLower(m.value)
+		err = validDomain(m.value)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		if m.fold {
+			m.value = strings.ToLower(m.value)
+		}
+	}
+
+	return m, nil
+}
+
+// addModifier applies a "/modifier" from the matcher's field name
+func (m *matcher) addModifier(mod string) error {
+	switch mod {
+	case modeRegex, modeGlob, modeDomain, modePrefix, modeSuffix:
+		if m.mode != "" {
+			return fmt.Errorf("sendmail/filter: only one of /%s, /%s, /%s, /%s, and /%s may be used",
+				modeRegex, modeGlob, modeDomain, modePrefix, modeSuffix)
+		}
+		m.mode = mod
+	case "i":
+		m.fold = true
+	case presenceExists, presenceMissing:
+		m.presence = mod
+	case quantAny, quantAll:
+		if m.quantifier != "" {
+			return fmt.Errorf("sendmail/filter: only one of /%s and /%s may be used", quantAny, quantAll)
+		}
+		m.quantifier = mod
+	default:
+		return fmt.Errorf("sendmail/filter: unknown match modifier %q", mod)
+	}
+	return nil
+}
+
+// recipients returns the envelope recipients and the addresses in To, Cc,
+// and Bcc, without duplicates.  Invalid fields are skipped.
+func recipients(e *email.Email) []string {
+	var seen = make(map[string]bool)
+	var list []string
+	var add = func(addr string) {
+		var key = strings.ToLower(addr)
+		if !seen[key] {
+			seen[key] = true
+			list = append(list, addr)
+		}
+	}
+
+	for _, addr := range e.Envelope.To {
+		add(addr)
+	}
+	for _, field := range []string{"to", "cc", "bcc"} {
+		var addrs, _ = e.Header.AddressList(field)
+		for _, addr := range addrs {
+			add(addr.Address)
+		}
+	}
+	return list
+}
+
+// fieldValues returns the email's values for the matcher's field: every
+// address for quantified matchers, otherwise a single value.  If there's no
+// value which could possibly match, ok is false.
+func (m *matcher) fieldValues(e *email.Email) (vals []string, ok bool) {
+	switch m.field {
+	case bodyField:
+		// Even a malformed message has some text to match
+		var text, err = e.Text()
+		if err != nil && text == "" {
+			text = string(e.Message)
+		}
+		return []string{text}, true
+	case sizeOverField, sizeUnderField:
+		return []string{strconv.Itoa(e.Size())}, true
+	case attachmentField:
+		var parts, _ = e.Parts()
+		for _, p := range parts {
+			if p.Attachment {
+				return []string{"yes"}, true
+			}
+		}
+		return []string{"no"}, true
+	case partTypeField, filenameField:
+		var parts, _ = e.Parts()
+		for _, p := range parts {
+			switch {
+			case m.field == partTypeField:
+				vals = append(vals, p.ContentType)
+			case p.Attachment && p.Filename != "":
+				vals = append(vals, p.Filename)
+			}
+		}
+		return vals, len(vals) > 0
+	}
+
+	if m.presence != "" {
+		vals = e.Header.Values(m.field)
+		return vals, len(vals) > 0
+	}
+
+	if m.quantifier != "" {
+		switch {
+		case m.field == rcptField:
+			vals = recipients(e)
+		case addressFields[m.field]:
+			var list, err = e.Header.AddressList(m.field)
+			if err != nil {
+				return nil, false
+			}
+			for _, addr := range list {
+				vals = append(vals, addr.Address)
+			}
+		default:
+			vals = e.Header.Values(m.field)
+		}
+		if len(vals) > MaxAddresses {
+			if m.quantifier == quantAll {
+				return nil, false
+			}
+			vals = vals[:MaxAddresses]
+		}
+		return vals, len(vals) > 0
+	}
+
+	// For email-containing fields, we attempt to grab an address and use that.
+	// We don't care about errors here, because lack of a valid address just
+	// means it can't match *anything*.
+	if addressFields[m.field] {
+		var addr, err = e.Header.Address(m.field)
+		if err != nil || addr == nil {
+			return nil, false
+		}
+		return []string{addr.Address}, true
+	}
+
+	return []string{e.Header.Get(m.field)}, true
+}
+
+func (m *matcher) match(e *email.Email, caps Captures) bool {
+	var matched, val = m.matchValues(e)
+	if matched == m.negate {
+		return false
+	}
+	if caps != nil && !m.negate && m.mode == modeRegex {
+		caps.add(m.re, m.re.FindStringSubmatch(val))
+	}
+	return true
+}
+
+// matchValues returns whether the email matches, ignoring negation, and the
+// value which matched: the first matching value, or with "/all", the first
+// value
+func (m *matcher) matchValues(e *email.Email) (bool, string) {
+	if m.catchall {
+		return true, ""
+	}
+
+	var vals, ok = m.fieldValues(e)
+	switch m.presence {
+	case presenceExists:
+		return ok, ""
+	case presenceMissing:
+		return !ok, ""
+	}
+	if !ok {
+		return false, ""
+	}
+	for _, val := range vals {
+		var matched = m.matchValue(val)
+		if matched && m.quantifier != quantAll {
+			return true, val
+		}
+		if !matched && m.quantifier == quantAll {
+			return false, ""
+		}
+	}
+	if m.quantifier == quantAll && len(vals) > 0 {
+		return true, vals[0]
+	}
+	return m.quantifier == quantAll, ""
+}
+
+// matchValue returns whether a single value matches
+func (m *matcher) matchValue(val string) bool {
+	switch m.field {
+	case sizeOverField, sizeUnderField:
+		var n, _ = strconv.ParseInt(val, 10, 64)
+		return (m.field == sizeOverField && n > m.size) || (m.field == sizeUnderField && n < m.size)
+	}
+
+	switch m.mode {
+	case modeRegex, modeGlob:
+		return m.re.MatchString(val)
+	case modeDomain:
+		return matchDomain(m.value, val)
+	}
+
+	if m.fold {
+		val = strings.ToLower(val)
+	}
+	switch m.mode {
+	case modePrefix:
+		return strings.HasPrefix(val, m.value)
+	case modeSuffix:
+		return strings.HasSuffix(val, m.value)
+	}
+	return m.value == val
+}
+
+// maxExplainValue is the longest value Explain reports, so a message body
+// doesn't swamp the output
+const maxExplainValue = 200
+
+func (m *matcher) explain(e *email.Email, depth int) []MatchResult {
+	var result = MatchResult{Matcher: m.condition, Matched: m.match(e, nil), Depth: depth}
+	if !m.catchall {
+		var vals []string
+		vals, result.HasValue = m.fieldValues(e)
+		result.Value = strings.Join(vals, ", ")
+		if len(result.Value) > maxExplainValue {
+			result.Value = result.Value[:maxExplainValue] + "..."
+		}
+	}
+	return []MatchResult{result}
+}
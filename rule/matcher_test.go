@@ -0,0 +1,213 @@
+package rule
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/Nerdmaster/sendmail/email"
+)
+
+func TestMatcherModifiers(t *testing.T) {
+	var _, err = newMatcher("From/regex/any:x")
+	if err != nil {
+		t.Errorf("regex and any should combine: %s", err)
+	}
+
+	var bad = []string{"From/bogus:x", "body/all:x", "To/any/all:x", "To/regex:("}
+	for _, cond := range bad {
+		_, err = newMatcher(cond)
+		if err == nil {
+			t.Errorf("%q should be an invalid matcher", cond)
+		}
+	}
+}
+
+func TestMatcherQuantifiers(t *testing.T) {
+	var e = email.New()
+	e.Header.Set("to", "alice@a.example, Ops <ops@b.example>")
+	e.Header.Set("cc", "carol@b.example")
+	e.Envelope.To = []string{"dave@c.example"}
+
+	var tests = []struct {
+		condition string
+		expected  bool
+	}{
+		{"To:ops@b.example", false},
+		{"To/any:ops@b.example", true},
+		{"To/any:nobody@b.example", false},
+		{`To/all/regex:@(a|b)\.example$`, true},
+		{`To/all/regex:@b\.example$`, false},
+		{"Cc/all:carol@b.example", true},
+		{"Bcc/any:carol@b.example", false},
+		{"rcpt:dave@c.example", true},
+		{"rcpt:carol@b.example", true},
+		{"rcpt:eve@c.example", false},
+		{`rcpt/all/regex:\.example$`, true},
+		{`rcpt/all/regex:@b\.example$`, false},
+		{"!rcpt:eve@c.example", true},
+	}
+	for _, test := range tests {
+		var r = mkrule(t, test.condition)
+		if r.Match(e) != test.expected {
+			t.Errorf("%q: expected %v", test.condition, test.expected)
+		}
+	}
+}
+
+func TestMatcherLimits(t *testing.T) {
+	var addrs []string
+	for i := 0; i <= MaxAddresses; i++ {
+		addrs = append(addrs, fmt.Sprintf("user%d@example.com", i))
+	}
+	var e = email.New()
+	e.Header.Set("cc", strings.Join(addrs, ", "))
+
+	if !mkrule(t, "Cc/any:user0@example.com").Match(e) {
+		t.Errorf("any should match addresses within the limit")
+	}
+	if mkrule(t, fmt.Sprintf("Cc/any:user%d@example.com", MaxAddresses)).Match(e) {
+		t.Errorf("any shouldn't look past the limit")
+	}
+	if mkrule(t, `Cc/all/regex:@example\.com$`).Match(e) {
+		t.Errorf("all shouldn't match lists over the limit")
+	}
+}
+
+func TestMatcherMessage(t *testing.T) {
+	var e, err = email.Read(strings.NewReader("From: me@example.org\n" +
+		"Content-Type: multipart/mixed; boundary=b\n\n" +
+		"--b\nContent-Type: text/plain\nContent-Transfer-Encoding: quoted-printable\n\nInvoice=20attached\n" +
+		"--b\nContent-Type: application/pdf\nContent-Disposition: attachment; filename=invoice-42.pdf\n\nxx\n" +
+		"--b--\n"))
+	if err != nil {
+		t.Fatalf("Couldn't read email: %s", err)
+	}
+	var plain = email.New()
+	plain.Header.Set("from", "me@example.org")
+	plain.Message = []byte("Just text")
+
+	var tests = []struct {
+		condition string
+		e         *email.Email
+		expected  bool
+	}{
+		{"body/regex:^Invoice attached", e, true},
+		{"body/regex:xx", e, false},
+		{"body:Just text", plain, true},
+		{"size>:100", e, true},
+		{"size<:1k", e, true},
+		{"size>:1M", e, false},
+		{"attachment:yes", e, true},
+		{"attachment:no", plain, true},
+		{"part-type:application/pdf", e, true},
+		{"part-type/all:text/plain", e, false},
+		{"part-type:text/plain", plain, true},
+		{`filename/regex:\.pdf$`, e, true},
+		{`filename/regex:.`, plain, false},
+	}
+	for _, test := range tests {
+		var r = mkrule(t, test.condition)
+		if r.Match(test.e) != test.expected {
+			t.Errorf("%q: expected %v", test.condition, test.expected)
+		}
+	}
+
+	var bad = []string{"size>:10Q", "size>/regex:1", "attachment:maybe", "body/any:x"}
+	for _, cond := range bad {
+		_, err = newMatcher(cond)
+		if err == nil {
+			t.Errorf("%q should be an invalid matcher", cond)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	var tests = map[string]int64{"512": 512, "10k": 10240, "2 MB": 2 << 20, "1G": 1 << 30}
+	for s, expected := range tests {
+		var n, err = parseSize(s)
+		if err != nil || n != expected {
+			t.Errorf("parseSize(%q): expected %d, got %d (%v)", s, expected, n, err)
+		}
+	}
+}
+
+func TestMatcherModes(t *testing.T) {
+	var e = email.New()
+	e.Header.Set("from", "Me@Mail.Example.com")
+	e.Header.Set("subject", "[cron] Backup report")
+
+	var tests = []struct {
+		condition string
+		expected  bool
+	}{
+		{"From:me@mail.example.com", false},
+		{"From/i:me@mail.example.com", true},
+		{"From/domain:mail.example.com", true},
+		{"From/domain:example.com", false},
+		{"From/domain:.example.com", true},
+		{"From/domain:.ample.com", false},
+		{"Subject/glob:[[]cron] *", true},
+		{"Subject/glob:*report", true},
+		{"Subject/glob:*REPORT", false},
+		{"Subject/glob/i:*REPORT", true},
+		{"Subject/glob:Backup*", false},
+		{"Subject/prefix:[cron]", true},
+		{"Subject/prefix:[CRON]", false},
+		{"Subject/prefix/i:[CRON]", true},
+		{"Subject/suffix:report", true},
+		{"Subject/regex/i:BACKUP", true},
+	}
+	for _, test := range tests {
+		var r = mkrule(t, test.condition)
+		if r.Match(e) != test.expected {
+			t.Errorf("%q: expected %v", test.condition, test.expected)
+		}
+	}
+
+	var bad = []string{"From/regex/glob:x", "From/domain:me@example.com", "From/domain:.", "Subject/glob:[abc"}
+	for _, cond := range bad {
+		var _, err = newMatcher(cond)
+		if err == nil {
+			t.Errorf("%q should be an invalid matcher", cond)
+		}
+	}
+}
+
+func TestMatcherHeaderValues(t *testing.T) {
+	var e, err = email.Read(strings.NewReader("From: me@example.org\nX-Tag: alpha\nX-Tag: beta\nX-Empty:\n\nhi"))
+	if err != nil {
+		t.Fatalf("Couldn't read email: %s", err)
+	}
+
+	var tests = []struct {
+		condition string
+		expected  bool
+	}{
+		{"X-Tag:beta", false},
+		{"X-Tag/any:beta", true},
+		{"X-Tag/all/regex:^(alpha|beta)$", true},
+		{"X-Tag/all:alpha", false},
+		{"X-Tag/exists:", true},
+		{"X-Empty/exists:", true},
+		{"X-Empty/missing:", false},
+		{"X-Nope/missing:", true},
+		{"X-Nope/exists:", false},
+		{"X-Nope:", true},
+		{"!Cc/exists:", true},
+	}
+	for _, test := range tests {
+		var r = mkrule(t, test.condition)
+		if r.Match(e) != test.expected {
+			t.Errorf("%q: expected %v", test.condition, test.expected)
+		}
+	}
+
+	var bad = []string{"X-Tag/exists:yes", "X-Tag/exists/i:", "body/missing:"}
+	for _, cond := range bad {
+		_, err = newMatcher(cond)
+		if err == nil {
+			t.Errorf("%q should be an invalid matcher", cond)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package rule
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/Nerdmaster/sendmail/email"
+)
+
+// Recipient actions change who a message is delivered to by editing its
+// envelope.  Before the first change, the envelope's recipients are filled in
+// from the To, Cc, and Bcc fields if they weren't already set, so the header
+// and envelope can change independently.  The "/headers" variants of each
+// action (e.g., "Redirect/headers") make the same change to the header's
+// address fields as well.
+
+// recipientFields are the header fields which list recipients
+var recipientFields = []string{"to", "cc", "bcc"}
+
+// materialize fills in the envelope recipients from the header if they
+// aren't set yet and haven't all been removed.  A To, Cc, or Bcc field which
+// can't be parsed is an error, since changing the recipients without it would
+// quietly drop whoever it was addressed to.
+func materialize(e *email.Email) error {
+	if len(e.Envelope.To) > 0 || e.Envelope.NoRecipients {
+		return nil
+	}
+	var rcpts, err = e.Recipients()
+	if err != nil {
+		return fmt.Errorf("unable to read recipients: %s", err)
+	}
+	for _, addr := range rcpts {
+		e.Envelope.To = email.AppendAddress(e.Envelope.To, addr)
+	}
+	return nil
+}
+
+// editEnvelope replaces each envelope recipient with edit's return value,
+// dropping any for which it returns an empty string.  If every recipient is
+// dropped, the envelope is marked as having none.
+func editEnvelope(e *email.Email, edit func(addr string) string) error {
+	var err = materialize(e)
+	if err != nil {
+		return err
+	}
+	var out []string
+	for _, addr := range e.Envelope.To {
+		var newAddr = edit(addr)
+		if newAddr != "" {
+			out = email.AppendAddress(out, newAddr)
+		}
+	}
+	e.Envelope.To = out
+	e.Envelope.NoRecipients = len(out) == 0
+	return nil
+}
+
+// editHeaders does the same as editEnvelope to the addresses in the To, Cc,
+// and Bcc fields.  Fields left with no addresses are removed, and fields which
+// can't be parsed are left alone.
+func editHeaders(e *email.Email, edit func(addr string) string) {
+	for _, field := range recipientFields {
+		var list, err = e.Header.AddressList(field)
+		if err != nil || len(list) == 0 {
+			continue
+		}
+
+		var out email.AddressList
+		for _, addr := range list {
+			var newAddr = edit(addr.Address)
+			if newAddr != "" {
+				out = append(out, &mail.Address{Name: addr.Name, Address: newAddr})
+			}
+		}
+		if len(out) == 0 {
+			e.Header.Del(field)
+		} else {
+			e.Header.Set(field, out.String())
+		}
+	}
+}
+
+// addressList is a recipient action's comma-separated address list.  A list
+// with a template in it, e.g., "{{index .Captures "1"}}@example.com", is
+// rendered and parsed for each message.
+type addressList struct {
+	cmd  string
+	list email.AddressList
+	tmpl *template.Template
+}
+
+// parseAddresses parses an action's address list.  Unlike other action
+// templates, a templated list is strict about missing map keys, as a
+// misspelled capture shouldn't quietly send mail to the wrong place.
+func parseAddresses(cmd, data string) (*addressList, error) {
+	if strings.Contains(data, "{{") {
+		var tmpl, err = newTemplate(cmd, data)
+		if err != nil {
+			return nil, err
+		}
+		return &addressList{cmd: cmd, tmpl: tmpl.Option("missingkey=error")}, nil
+	}
+
+	var list, err = mail.ParseAddressList(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s syntax: %s", cmd, err)
+	}
+	return &addressList{cmd: cmd, list: list}, nil
+}
+
+// addresses returns the list, rendering it first if it's a template.  A
+// template which fails to render, or renders to anything but a valid address
+// list, is an error: delivering to the original recipients instead would
+// send the message somewhere the rule said it shouldn't go.
+func (l *addressList) addresses(e *email.Email, r *Rule, caps Captures) (email.AddressList, error) {
+	if l.tmpl == nil {
+		return l.list, nil
+	}
+	var text, err = execute(l.tmpl, e, r, caps)
+	if err != nil {
+		return nil, fmt.Errorf("%s: unable to render address list: %s", l.cmd, err)
+	}
+	var list email.AddressList
+	list, err = mail.ParseAddressList(text)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid address list %q: %s", l.cmd, text, err)
+	}
+	return list, nil
+}
+
+// actRedirect replaces every recipient
+type actRedirect struct {
+	to      *addressList
+	headers bool
+}
+
+func newActRedirect(data string, headers bool) (action, error) {
+	var list, err = parseAddresses("Redirect", data)
+	if err != nil {
+		return nil, err
+	}
+	return &actRedirect{to: list, headers: headers}, nil
+}
+
+func (a *actRedirect) apply(e *email.Email, r *Rule, caps Captures) error {
+	var to, err = a.to.addresses(e, r, caps)
+	if err != nil {
+		return err
+	}
+
+	e.Envelope.To = nil
+	e.Envelope.NoRecipients = false
+	for _, addr := range to {
+		e.Envelope.To = email.AppendAddress(e.Envelope.To, addr.Address)
+	}
+
+	if a.headers {
+		e.Header.Set("to", to.String())
+		e.Header.Del("cc")
+		e.Header.Del("bcc")
+	}
+	return nil
+}
+
+// actAddRecipient adds recipients, e.g., for an archive copy.  With headers,
+// they're added to the Cc field.
+type actAddRecipient struct {
+	addrs   *addressList
+	headers bool
+}
+
+func newActAddRecipient(data string, headers bool) (action, error) {
+	return parseAddRecipient("AddRecipient", data, headers)
+}
+
+// newActAlwaysBcc parses AlwaysBcc, an alias for AddRecipient, so its
+// errors use the name the config does
+func newActAlwaysBcc(data string) (action, error) {
+	return parseAddRecipient("AlwaysBcc", data, false)
+}
+
+func parseAddRecipient(cmd, data string, headers bool) (action, error) {
+	var list, err = parseAddresses(cmd, data)
+	if err != nil {
+		return nil, err
+	}
+	return &actAddRecipient{addrs: list, headers: headers}, nil
+}
+
+func (a *actAddRecipient) apply(e *email.Email, r *Rule, caps Captures) error {
+	var addrs, err = a.addrs.addresses(e, r, caps)
+	if err != nil {
+		return err
+	}
+
+	err = materialize(e)
+	if err != nil {
+		return err
+	}
+	e.Envelope.NoRecipients = false
+	for _, addr := range addrs {
+		e.Envelope.To = email.AppendAddress(e.Envelope.To, addr.Address)
+	}
+
+	if a.headers {
+		var cc email.AddressList
+		cc, err = e.Header.AddressList("cc")
+		if err != nil {
+			return fmt.Errorf("%s: unable to add to the Cc field: %s", a.addrs.cmd, err)
+		}
+		for _, addr := range addrs {
+			if !cc.Contains(addr.Address) {
+				cc = append(cc, addr)
+			}
+		}
+		e.Header.Set("cc", cc.String())
+	}
+	return nil
+}
+
+// actDropRecipient removes recipients matching a pattern: a "/regex/" or a
+// shell-style glob like "*@example.com".  Patterns are case-insensitive.
+type actDropRecipient struct {
+	re      *regexp.Regexp
+	headers bool
+}
+
+func newActDropRecipient(data string, headers bool) (action, error) {
+	data = strings.TrimSpace(data)
+	if data == "" || data == "//" {
+		return nil, errors.New("invalid DropRecipient syntax: missing pattern")
+	}
+	var re *regexp.Regexp
+	var err error
+	if len(data) > 1 && strings.HasPrefix(data, "/") && strings.HasSuffix(data, "/") {
+		re, err = regexp.Compile("(?i)" + data[1:len(data)-1])
+	} else {
+		re, err = globRegexp(data, true)
+	}
+	if err != nil {
+		return nil, errors.New("invalid DropRecipient syntax: " + err.Error())
+	}
+	return &actDropRecipient{re: re, headers: headers}, nil
+}
+
+func (a *actDropRecipient) drop(addr string) string {
+	if a.re.MatchString(addr) {
+		return ""
+	}
+	return addr
+}
+
+func (a *actDropRecipient) apply(e *email.Email, r *Rule, caps Captures) error {
+	var err = editEnvelope(e, a.drop)
+	if err != nil {
+		return err
+	}
+	if a.headers {
+		editHeaders(e, a.drop)
+	}
+	return nil
+}
+
+// actRewriteDomain changes the domain of recipients in one domain to another.
+// A leading dot on the old domain also rewrites its subdomains.
+type actRewriteDomain struct {
+	from    string
+	to      string
+	headers bool
+}
+
+func newActRewriteDomain(data string, headers bool) (action, error) {
+	var fields = strings.Fields(data)
+	if len(fields) != 2 {
+		return nil, errors.New("invalid RewriteDomain syntax: must be \"old-domain new-domain\"")
+	}
+	var a = &actRewriteDomain{from: strings.ToLower(fields[0]), to: fields[1], headers: headers}
+	for _, d := range []string{a.from, a.to} {
+		var err = validDomain(d)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if strings.HasPrefix(a.to, ".") {
+		return nil, errors.New("invalid RewriteDomain syntax: the new domain can't start with a dot")
+	}
+	return a, nil
+}
+
+func (a *actRewriteDomain) rewrite(addr string) string {
+	var at = strings.LastIndex(addr, "@")
+	if at < 0 || !matchDomain(a.from, addr) {
+		return addr
+	}
+	return addr[:at+1] + a.to
+}
+
+func (a *actRewriteDomain) apply(e *email.Email, r *Rule, caps Captures) error {
+	var err = editEnvelope(e, a.rewrite)
+	if err != nil {
+		return err
+	}
+	if a.headers {
+		editHeaders(e, a.rewrite)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package rule
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Nerdmaster/sendmail/email"
+	"github.com/uoregon-libraries/gopkg/assert"
+)
+
+func mkRcptEmail(t *testing.T) *email.Email {
+	var e, err = email.Read(strings.NewReader("From: me@example.org\n" +
+		"To: Alice <alice@example.org>, bob@mail.example.org\nCc: carol@other.example\nBcc: dave@example.org\n\nhi"))
+	if err != nil {
+		t.Fatalf("Couldn't read email: %s", err)
+	}
+	return e
+}
+
+func TestRuleActionRedirect(t *testing.T) {
+	var e = mkRcptEmail(t)
+	mkActRule(t, "Redirect catch@example.net").Apply(e)
+	assert.Equal("catch@example.net", strings.Join(e.Envelope.To, ","), "envelope", t)
+	assert.Equal("carol@other.example", e.Header.Get("cc"), "header is untouched", t)
+
+	e = mkRcptEmail(t)
+	mkActRule(t, "Redirect/headers catch@example.net").Apply(e)
+	assert.Equal("catch@example.net", strings.Join(e.Envelope.To, ","), "envelope", t)
+	assert.Equal("<catch@example.net>", e.Header.Get("to"), "to header", t)
+	assert.Equal("", e.Header.Get("cc"), "cc header", t)
+
+	e = mkRcptEmail(t)
+	var r = mkActRule(t, `Redirect {{.Captures.user}}@example.net`)
+	r.ApplyCaptures(e, Captures{"user": "alice"})
+	assert.Equal("alice@example.net", strings.Join(e.Envelope.To, ","), "templated envelope", t)
+
+	// A template which doesn't render to valid addresses is an error, and a
+	// missing capture fails to render rather than rendering as "<no value>"
+	e = mkRcptEmail(t)
+	e.Envelope.To = []string{"only@example.org"}
+	var err = r.Apply(e)
+	assert.True(err != nil, "missing capture is an error", t)
+	assert.True(strings.Contains(err.Error(), "Redirect"), "error names the action: "+err.Error(), t)
+
+	err = r.ApplyCaptures(e, Captures{"user": "not an address"})
+	assert.True(err != nil, "invalid rendered address is an error", t)
+
+	e = mkRcptEmail(t)
+	r = mkActRule(t, `AddRecipient {{.Captures.user}}@example.net`, "SetHeader X-After:yes")
+	err = r.Apply(e)
+	assert.True(err != nil, "AddRecipient with a missing capture is an error", t)
+	assert.Equal("", e.Header.Get("x-after"), "actions after a failure aren't run", t)
+}
+
+func TestRuleActionAddRecipient(t *testing.T) {
+	var e = mkRcptEmail(t)
+	mkActRule(t, "AlwaysBcc archive@example.org", "AddRecipient/headers audit@example.org").Apply(e)
+	assert.Equal("alice@example.org,bob@mail.example.org,carol@other.example,dave@example.org,"+
+		"archive@example.org,audit@example.org", strings.Join(e.Envelope.To, ","), "envelope", t)
+	assert.Equal("<carol@other.example>,<audit@example.org>", e.Header.Get("cc"), "cc header", t)
+
+	// An existing envelope isn't replaced by the header's recipients
+	e = mkRcptEmail(t)
+	e.Envelope.To = []string{"only@example.org"}
+	mkActRule(t, "AddRecipient archive@example.org").Apply(e)
+	assert.Equal("only@example.org,archive@example.org", strings.Join(e.Envelope.To, ","), "envelope", t)
+
+	// A Cc field which can't be parsed can't be added to
+	e, _ = email.Read(strings.NewReader("From: me@example.org\nTo: alice@example.org\nCc: not <an address\n\nhi"))
+	var err = mkActRule(t, "AddRecipient/headers audit@example.org").Apply(e)
+	assert.True(err != nil, "unparseable Cc field is an error", t)
+
+	err = (&Rule{}).AddAction("AlwaysBcc not an address")
+	assert.True(err != nil && strings.Contains(err.Error(), "AlwaysBcc"), "error uses the command's name: "+err.Error(), t)
+}
+
+func TestRuleActionDropRecipient(t *testing.T) {
+	var e = mkRcptEmail(t)
+	mkActRule(t, "DropRecipient *@EXAMPLE.ORG").Apply(e)
+	assert.Equal("bob@mail.example.org,carol@other.example", strings.Join(e.Envelope.To, ","), "envelope", t)
+	assert.Equal("Alice <alice@example.org>, bob@mail.example.org", e.Header.Get("to"), "header is untouched", t)
+
+	e = mkRcptEmail(t)
+	mkActRule(t, `DropRecipient/headers /example\.org$/`).Apply(e)
+	assert.Equal("carol@other.example", strings.Join(e.Envelope.To, ","), "envelope", t)
+	assert.Equal("", e.Header.Get("to"), "to header", t)
+	assert.Equal("<carol@other.example>", e.Header.Get("cc"), "cc header", t)
+
+	e = mkRcptEmail(t)
+	mkActRule(t, "DropRecipient *").Apply(e)
+	var rcpts, err = e.Recipients()
+	assert.NilError(err, "reading recipients", t)
+	assert.Equal(0, len(rcpts), "dropping everyone leaves no recipients, not the header's", t)
+	assert.True(e.Envelope.NoRecipients, "envelope is marked as having no recipients", t)
+
+	e = mkRcptEmail(t)
+	mkActRule(t, "DropRecipient *", "AddRecipient archive@example.com").Apply(e)
+	assert.Equal("archive@example.com", strings.Join(e.Envelope.To, ","), "recipients added after dropping everyone", t)
+	assert.False(e.Envelope.NoRecipients, "envelope has a recipient again", t)
+}
+
+func TestRuleActionRewriteDomain(t *testing.T) {
+	var e = mkRcptEmail(t)
+	mkActRule(t, "RewriteDomain example.org staging.example.org").Apply(e)
+	assert.Equal("alice@staging.example.org,bob@mail.example.org,carol@other.example,dave@staging.example.org",
+		strings.Join(e.Envelope.To, ","), "envelope", t)
+
+	e = mkRcptEmail(t)
+	mkActRule(t, "RewriteDomain/headers .example.org example.net").Apply(e)
+	assert.Equal("alice@example.net,bob@example.net,carol@other.example,dave@example.net",
+		strings.Join(e.Envelope.To, ","), "envelope", t)
+	assert.Equal(`"Alice" <alice@example.net>,<bob@example.net>`, e.Header.Get("to"), "to header", t)
+
+	var bad = []string{"RewriteDomain example.org", "RewriteDomain a@b c", "RewriteDomain a .b", "Redirect not an address",
+		"DropRecipient [x", "DropRecipient", "DropRecipient  ", "DropRecipient //"}
+	for _, astr := range bad {
+		var err = (&Rule{}).AddAction(astr)
+		if err == nil {
+			t.Errorf("%q should be an invalid action", astr)
+		}
+	}
+}
+
+func TestRecipientActionsInvalidTo(t *testing.T) {
+	var actions = []string{"AlwaysBcc archive@example.org", "AddRecipient archive@example.org",
+		"DropRecipient *@example.net", "RewriteDomain example.org example.net"}
+	for _, astr := range actions {
+		var e, _ = email.Read(strings.NewReader("From: me@example.org\nTo: not <an address\nCc: bob@example.org\n\nhi"))
+		var err = mkActRule(t, astr).Apply(e)
+		assert.True(err != nil, astr+": a To field which can't be parsed is an error", t)
+		assert.Equal(0, len(e.Envelope.To), astr+": envelope isn't changed", t)
+	}
+}
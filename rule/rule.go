@@ -2,119 +2,241 @@ package rule
 
 import (
 	"fmt"
-	"regexp"
-	"strings"
 
 	"github.com/Nerdmaster/sendmail/email"
 )
 
-type matcher struct {
-	field    string
-	value    string
-	catchall bool
-	regex    bool
-	re       *regexp.Regexp
+// condition is anything which can be matched against an email: a single
+// matcher or a group of them
+type condition interface {
+	match(e *email.Email, caps Captures) bool
+	explain(e *email.Email, depth int) []MatchResult
 }
 
-func newMatcher(condition string) (*matcher, error) {
-	if condition == "*" {
-		return &matcher{catchall: true}, nil
+// Group operators
+const (
+	All = "all"
+	Any = "any"
+	Not = "not"
+)
+
+// A Group combines matchers and other groups: an "all" group matches when
+// every member matches, "any" when at least one does, and "not" when none
+// do.  An empty group never matches.
+type Group struct {
+	op         string
+	conditions []condition
+}
+
+func newGroup(op string) (*Group, error) {
+	switch op {
+	case All, Any, Not:
+		return &Group{op: op}, nil
 	}
+	return nil, fmt.Errorf("sendmail/filter: unknown matcher group %q: must be %q, %q, or %q", op, All, Any, Not)
+}
 
-	var parts = strings.SplitN(condition, ":", 2)
-	if len(parts) != 2 {
-		return nil, fmt.Errorf("sendmail/filter: match condition format must have a colon")
+// AddMatcher converts a match string into a matcher and adds it to this
+// group.  See Rule.AddMatcher for the format.
+func (g *Group) AddMatcher(condition string) error {
+	var m, err = newMatcher(condition)
+	if err != nil {
+		return err
 	}
+	g.conditions = append(g.conditions, m)
+	return nil
+}
 
-	var m = &matcher{field: strings.ToLower(parts[0]), value: parts[1]}
-	if strings.HasSuffix(m.field, "/regex") {
-		m.field = m.field[:len(m.field)-6]
-		m.regex = true
-		var err error
-		m.re, err = regexp.Compile(m.value)
-		if err != nil {
-			return nil, fmt.Errorf("sendmail/filter: invalid match condition regex: %s", err)
-		}
+// AddGroup creates a new group with the given operator ("all", "any", or
+// "not") and adds it to this group
+func (g *Group) AddGroup(op string) (*Group, error) {
+	var sub, err = newGroup(op)
+	if err != nil {
+		return nil, err
 	}
+	g.conditions = append(g.conditions, sub)
+	return sub, nil
+}
 
-	return m, nil
+// Len returns the number of matchers and groups directly in this group
+func (g *Group) Len() int {
+	return len(g.conditions)
 }
 
-func (m *matcher) match(e *email.Email) bool {
-	if m.catchall {
-		return true
+// match reports whether the group matches.  Captures are recorded in caps
+// (if it isn't nil) only from members of a group which matched, and never
+// from a "not" group's members.
+func (g *Group) match(e *email.Email, caps Captures) bool {
+	if len(g.conditions) == 0 {
+		return false
 	}
 
-	var val string
-	switch m.field {
-	// For email-containing fields, we attempt to grab an address and use that.
-	// We don't care about errors here, because lack of a valid address just
-	// means it can't match *anything*.
-	case "to", "from", "cc", "bcc", "reply-to":
-		var addr, err = e.Header.Address(m.field)
-		if err != nil || addr == nil {
+	if g.op == Not {
+		caps = nil
+	}
+	var tmp = caps.clone()
+	for _, c := range g.conditions {
+		if g.op == Any {
+			tmp = caps.clone()
+		}
+		var matched = c.match(e, tmp)
+		switch {
+		case g.op == All && !matched:
+			return false
+		case g.op == Any && matched:
+			caps.merge(tmp)
+			return true
+		case g.op == Not && matched:
 			return false
 		}
-		val = addr.Address
-	default:
-		val = e.Header.Get(m.field)
 	}
+	if g.op == All {
+		caps.merge(tmp)
+	}
+	return g.op != Any
+}
 
-	if m.regex {
-		return m.re.MatchString(val)
+func (g *Group) explain(e *email.Email, depth int) []MatchResult {
+	var results = []MatchResult{{Matcher: g.op + ":", Matched: g.match(e, nil), Depth: depth, Group: true}}
+	for _, c := range g.conditions {
+		results = append(results, c.explain(e, depth+1)...)
 	}
-	return m.value == val
+	return results
 }
 
 // A Rule is a collection of match directives to determine if an email should
 // be handled
 type Rule struct {
-	matchers []*matcher
+	// Name and Vars are given to action templates as {{.Rule}} and {{.Vars}}
+	Name string
+	Vars map[string]string
+
+	matchers Group
 	actions  []action
+	terminal *actTerminal
 }
 
 // AddMatcher converts a match string into a matcher and adds it to this rule.
-// A match string is composed of: <field>[/regex]:<value>
+// A match string is composed of: [!]<field>[/modifier...]:<value>
 //
+//     - A leading "!" negates the matcher
 //     - Field name is case-insensitive per the RFC
 //     - Value is case-sensitive
 //     - Value must match the email's header field value exactly (see below)
 //     - If "/regex" is after the field, an email's field just needs to match
-//       the matcher's value as a regular expression
+//       the matcher's value as a regular expression.  Its capture groups
+//       are returned by MatchCaptures.
+//     - "/glob" matches shell-style wildcards ("*", "?", and "[...]")
+//     - "/prefix" and "/suffix" match the start or end of the field's value
+//     - "/domain" matches the domain of the field's address; a leading dot
+//       (e.g., ".example.com") also matches subdomains.  Domains are always
+//       case-insensitive.
+//     - Only one of the above may be used, but any can be combined with "/i"
+//       for a case-insensitive match
+//     - "/any" or "/all" after an address field matches if any or all of the
+//       field's addresses match.  On other header fields, they look at every
+//       value of a repeated field (e.g., "Received" or "X-Tag").
+//     - "/exists" and "/missing" check whether the field is present at all,
+//       e.g., "X-Spam-Flag/exists:".  They can't have a value or be combined
+//       with other modifiers.
 //
 // Note that matching on various email fields actually means matching on the
 // *address portion* of the field.  e.g., matching "somebody@example.org" in
 // the "From" field would work if "From" were "somebody@example.org" or "John
 // <somebody@example.org>".  The name is effectively ignored.  Additionally,
-// matchers won't scour all emails in a given field, as some fields like CC and
-// BCC can get absurdly large.  When matching on fields with multiple email
-// addresses, *only the first* email in the list will match.
+// matchers won't scour all emails in a given field unless told to with "/any"
+// or "/all", as some fields like CC and BCC can get absurdly large.  When
+// matching on fields with multiple email addresses, *only the first* email in
+// the list will match.
+//
+// The "rcpt" pseudo-field holds every recipient: the envelope recipients and
+// the addresses in To, Cc, and Bcc.  It matches if any recipient matches, or
+// with "/all", if every one does.  Quantified matchers only look at the first
+// MaxAddresses addresses.
+//
+// Other pseudo-fields look at the message rather than its header:
+//
+//     - "body" is the decoded text of every text part which isn't an
+//       attachment
+//     - "size>" and "size<" match messages over or under the given size,
+//       e.g., "size>:10M" (units are k, M, and G, as powers of 1024)
+//     - "attachment" is "yes" if the message has any attachments, else "no"
+//     - "part-type" is each MIME part's media type, e.g., "application/pdf",
+//       and "filename" is each attachment's file name.  Like "rcpt", these
+//       match if any value does, or every one with "/all".
 func (r *Rule) AddMatcher(condition string) error {
-	var m, err = newMatcher(condition)
-	if err != nil {
-		return err
-	}
-	r.matchers = append(r.matchers, m)
-	return nil
+	r.matchers.op = All
+	return r.matchers.AddMatcher(condition)
+}
+
+// AddGroup creates a new group with the given operator ("all", "any", or
+// "not") and adds it to this rule's matchers
+func (r *Rule) AddGroup(op string) (*Group, error) {
+	r.matchers.op = All
+	return r.matchers.AddGroup(op)
 }
 
-// Match returns true if all matchers match the given email
+// Match returns true if all matchers and groups match the given email
 func (r *Rule) Match(e *email.Email) bool {
-	if len(r.matchers) == 0 {
-		return false
+	return r.matchers.match(e, nil)
+}
+
+// MatchCaptures works like Match, and also returns the capture groups of the
+// regex matchers which matched.  See Captures.
+func (r *Rule) MatchCaptures(e *email.Email) (bool, Captures) {
+	var caps = make(Captures)
+	if !r.matchers.match(e, caps) {
+		return false, nil
 	}
+	return true, caps
+}
 
-	for _, matcher := range r.matchers {
-		if !matcher.match(e) {
-			return false
-		}
+// MatchResult describes how a single matcher fared against an email
+type MatchResult struct {
+	// Matcher is the condition string the matcher was built from
+	Matcher string
+
+	// Value is the email's value for the matcher's field, and HasValue is
+	// false when there's no value at all (e.g., no valid address in a "to"
+	// field).  Neither is set for the catch-all matcher or groups.
+	Value    string
+	HasValue bool
+
+	Matched bool
+
+	// Group is true for a group's own result, in which case Matcher is its
+	// operator followed by a colon.  The group's members follow it, with a
+	// Depth one deeper.
+	Group bool
+	Depth int
+}
+
+// Explain evaluates every matcher against the email, rather than stopping at
+// the first failure as Match does, and reports each one's result.  Groups
+// are listed before their members.
+func (r *Rule) Explain(e *email.Email) []MatchResult {
+	var results []MatchResult
+	for _, c := range r.matchers.conditions {
+		results = append(results, c.explain(e, 0)...)
 	}
-	return true
+	return results
 }
 
 // Apply runs all actions from this rule on the given email.Email
-func (r *Rule) Apply(e *email.Email) {
+func (r *Rule) Apply(e *email.Email) error {
+	return r.ApplyCaptures(e, nil)
+}
+
+// ApplyCaptures runs all actions from this rule on the email, giving their
+// templates the captures from MatchCaptures.  If an action fails, which only
+// recipient actions can do, the rest aren't run and the error is returned:
+// the message mustn't be sent with recipients the rule didn't intend.
+func (r *Rule) ApplyCaptures(e *email.Email, caps Captures) error {
 	for _, action := range r.actions {
-		action.apply(e)
+		var err = action.apply(e, r, caps)
+		if err != nil {
+			return err
+		}
 	}
+	return nil
 }
@@ -39,7 +39,7 @@ func TestRuleMatch(t *testing.T) {
 	}
 
 	if !regex.Match(e) {
-		t.Errorf("regex (%#v) should have matched the test email (%#v)", regex.matchers[0], e.Header)
+		t.Errorf("regex (%#v) should have matched the test email (%#v)", regex.matchers.conditions[0], e.Header)
 	}
 	if !regex.Match(e2) {
 		t.Errorf("regex (%#v) should have matched the second test email (%#v)", regex, e2)
@@ -59,3 +59,113 @@ func TestRuleMatch(t *testing.T) {
 		t.Errorf("regex shouldn't match an email with non-word characters")
 	}
 }
+
+func TestRuleExplain(t *testing.T) {
+	var e = email.New()
+	e.Header.Set("to", "Mister F. <tobias.f@example.com>")
+	e.Header.Set("subject", "hello")
+
+	var r = mkrule(t, "Subject:hello", `From/regex:^\w*@example.com$`, "To:tobias.f@example.com")
+	var results = r.Explain(e)
+	if len(results) != 3 {
+		t.Fatalf("Expected 3 results, got %d", len(results))
+	}
+
+	var expected = []MatchResult{
+		{Matcher: "Subject:hello", Value: "hello", HasValue: true, Matched: true},
+		{Matcher: `From/regex:^\w*@example.com$`, Value: "", HasValue: false, Matched: false},
+		{Matcher: "To:tobias.f@example.com", Value: "tobias.f@example.com", HasValue: true, Matched: true},
+	}
+	for i, exp := range expected {
+		if results[i] != exp {
+			t.Errorf("Result %d: expected %#v, got %#v", i, exp, results[i])
+		}
+	}
+}
+
+func TestRuleNegate(t *testing.T) {
+	var e = email.New()
+	e.Header.Set("from", "somebody@example.com")
+
+	if mkrule(t, "!From:somebody@example.com").Match(e) {
+		t.Errorf("negated matcher shouldn't match")
+	}
+	if !mkrule(t, "!From:nobody@example.com").Match(e) {
+		t.Errorf("negated matcher should match")
+	}
+	if !mkrule(t, "!To:x@example.com").Match(e) {
+		t.Errorf("negated matcher should match a missing field")
+	}
+}
+
+func TestRuleGroups(t *testing.T) {
+	var e = email.New()
+	e.Header.Set("from", "somebody@example.org")
+	e.Header.Set("subject", "cron report")
+
+	var mkgroup = func(op string, slist ...string) *Rule {
+		var r = &Rule{}
+		var g, err = r.AddGroup(op)
+		if err != nil {
+			t.Fatalf("Error adding %q group: %s", op, err)
+		}
+		for _, s := range slist {
+			err = g.AddMatcher(s)
+			if err != nil {
+				t.Fatalf("Error building a group: matcher %q failed: %s", s, err)
+			}
+		}
+		return r
+	}
+
+	var tests = []struct {
+		rule     *Rule
+		expected bool
+		desc     string
+	}{
+		{mkgroup(Any, "From:a@example.com", "From:somebody@example.org"), true, "any with one match"},
+		{mkgroup(Any, "From:a@example.com", "From:b@example.com"), false, "any with no matches"},
+		{mkgroup(All, "From:somebody@example.org", "Subject:cron report"), true, "all with all matches"},
+		{mkgroup(All, "From:somebody@example.org", "Subject:hi"), false, "all with one failure"},
+		{mkgroup(Not, "From:a@example.com", "Subject:hi"), true, "not with no matches"},
+		{mkgroup(Not, "From:a@example.com", "Subject:cron report"), false, "not with one match"},
+		{mkgroup(Any), false, "empty group"},
+	}
+	for _, test := range tests {
+		if test.rule.Match(e) != test.expected {
+			t.Errorf("%s: expected %v", test.desc, test.expected)
+		}
+	}
+
+	var _, err = (&Rule{}).AddGroup("xor")
+	if err == nil {
+		t.Errorf("unknown group operators should be errors")
+	}
+
+	// Nested: from example.org, and not a cron report or a test
+	var r = mkrule(t, "From/regex:@example.org$")
+	var not, _ = r.AddGroup(Not)
+	var any, _ = not.AddGroup(Any)
+	any.AddMatcher("Subject:cron report")
+	any.AddMatcher("Subject:test")
+	if r.Match(e) {
+		t.Errorf("nested groups shouldn't match a cron report")
+	}
+
+	var results = r.Explain(e)
+	var expected = []MatchResult{
+		{Matcher: "From/regex:@example.org$", Value: "somebody@example.org", HasValue: true, Matched: true},
+		{Matcher: "not:", Matched: false, Group: true},
+		{Matcher: "any:", Matched: true, Group: true, Depth: 1},
+		{Matcher: "Subject:cron report", Value: "cron report", HasValue: true, Matched: true, Depth: 2},
+		{Matcher: "Subject:test", Value: "cron report", HasValue: true, Matched: false, Depth: 2},
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("Expected %d results, got %d", len(expected), len(results))
+	}
+	for i, exp := range expected {
+		if results[i] != exp {
+			t.Errorf("Result %d: expected %#v, got %#v", i, exp, results[i])
+		}
+	}
+}
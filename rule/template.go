@@ -0,0 +1,166 @@
+package rule
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"net/mail"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/Nerdmaster/sendmail/email"
+)
+
+// templateFuncs are the functions available to action templates
+var templateFuncs = template.FuncMap{
+	"address":  tmplAddress,
+	"domain":   tmplDomain,
+	"name":     tmplName,
+	"lower":    strings.ToLower,
+	"upper":    strings.ToUpper,
+	"now":      time.Now,
+	"env":      os.Getenv,
+	"hostname": tmplHostname,
+	"uuid":     tmplUUID,
+	"replace":  tmplReplace,
+}
+
+// tmplAddress returns the address portion of s, e.g., "jo@example.org" from
+// "Jo <jo@example.org>".  If s can't be parsed, it's returned trimmed.
+func tmplAddress(s string) string {
+	var addr, err = mail.ParseAddress(s)
+	if err != nil {
+		return strings.TrimSpace(s)
+	}
+	return addr.Address
+}
+
+// tmplDomain returns the domain of the address in s
+func tmplDomain(s string) string {
+	var addr = tmplAddress(s)
+	return addr[strings.LastIndex(addr, "@")+1:]
+}
+
+// tmplName returns the display name of the address in s, if it has one
+func tmplName(s string) string {
+	var addr, err = mail.ParseAddress(s)
+	if err != nil {
+		return ""
+	}
+	return addr.Name
+}
+
+func tmplHostname() (string, error) {
+	return os.Hostname()
+}
+
+// tmplUUID returns a random (version 4) UUID
+func tmplUUID() (string, error) {
+	var b = make([]byte, 16)
+	var _, err = rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// tmplReplace replaces every match of the regex in s.  The arguments are
+// ordered so it can be used in a pipeline: {{.Get "subject" | replace "^Re: " ""}}
+func tmplReplace(pattern, repl, s string) (string, error) {
+	var re, err = regexp.Compile(pattern)
+	if err != nil {
+		return "", err
+	}
+	return re.ReplaceAllString(s, repl), nil
+}
+
+// templateData is what action templates are executed against.  The header
+// is embedded so its methods can be called directly, e.g., {{.Get "from"}}
+// or {{.Address "from"}}, as they could when templates were run against the
+// header alone; it's also available as {{.Header}}.
+type templateData struct {
+	email.Header
+	Envelope email.Envelope
+
+	// Rule is the name of the rule whose action is running, if it has one
+	Rule string
+
+	// Vars holds the variables from the config
+	Vars map[string]string
+
+	// Captures holds the capture groups from the rule's regex matchers
+	Captures Captures
+}
+
+// newTemplate parses an action's template, naming the action in errors.  A
+// missing var or capture renders as an empty string rather than "<no value>".
+func newTemplate(cmd, text string) (*template.Template, error) {
+	var tmpl, err = template.New(cmd).Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s syntax: %s", cmd, err)
+	}
+	return tmpl, nil
+}
+
+// lineBreaks matches the runs of CR and LF which render replaces
+var lineBreaks = regexp.MustCompile(`[\r\n]+`)
+
+// render executes an action's template against the email as it is now.  If
+// execution fails, the error is logged and whatever was rendered before the
+// failure is returned.  Line breaks are replaced with spaces, since every
+// rendered value goes into a single header field or envelope address, and a
+// value taken from the message (e.g., a body capture) mustn't be able to add
+// header lines of its own.
+func render(tmpl *template.Template, e *email.Email, r *Rule, caps Captures) string {
+	var s, err = execute(tmpl, e, r, caps)
+	if err != nil {
+		var name = r.Name
+		if name == "" {
+			name = "(unnamed)"
+		}
+		log.Printf("sendmail/rule: rule %s: %s", name, err)
+	}
+	return lineBreaks.ReplaceAllString(s, " ")
+}
+
+func execute(tmpl *template.Template, e *email.Email, r *Rule, caps Captures) (string, error) {
+	var data = &templateData{Header: e.Header, Envelope: e.Envelope, Rule: r.Name, Vars: r.Vars, Captures: caps}
+	var b bytes.Buffer
+	var err = tmpl.Execute(&b, data)
+	return b.String(), err
+}
+
+// A Template is parsed and rendered the same way as action templates, for
+// settings outside the rule which depend on the message, like which
+// transport to use
+type Template struct {
+	text string
+	tmpl *template.Template
+}
+
+// NewTemplate parses text as a Template
+func NewTemplate(text string) (*Template, error) {
+	var tmpl, err = template.New("tmpl").Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &Template{text: text, tmpl: tmpl}, nil
+}
+
+// String returns the template's text
+func (t *Template) String() string {
+	return t.text
+}
+
+// Render executes the template against the email as if it were one of the
+// rule's actions.  Unlike action templates, which render as much as they can,
+// a template which fails to execute returns an error.
+func (r *Rule) Render(t *Template, e *email.Email, caps Captures) (string, error) {
+	return execute(t.tmpl, e, r, caps)
+}
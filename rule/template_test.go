@@ -0,0 +1,100 @@
+package rule
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/Nerdmaster/sendmail/email"
+	"github.com/uoregon-libraries/gopkg/assert"
+)
+
+func TestTemplateFuncs(t *testing.T) {
+	var e, err = email.Read(strings.NewReader("From: Jo Smith <Jo@Example.org>\nSubject: [ext] Re: hi\n\nhi"))
+	if err != nil {
+		t.Fatalf("Couldn't read email: %s", err)
+	}
+	os.Setenv("SENDMAIL_TEST_VAR", "from-env")
+
+	var r = mkActRule(t,
+		`SetHeader X-Address:{{.Get "from" | address}}`,
+		`SetHeader X-Domain:{{.Get "from" | domain | lower}}`,
+		`SetHeader X-Name:{{.Get "from" | name | upper}}`,
+		`SetHeader X-Subject:{{.Get "subject" | replace "^\\[ext\\] " ""}}`,
+		`SetHeader X-Env:{{env "SENDMAIL_TEST_VAR"}}`,
+		`SetHeader X-Year:{{now.Format "2006"}}`,
+		`SetHeader X-ID:{{uuid}}`,
+	)
+	r.Apply(e)
+	assert.Equal("Jo@Example.org", e.Header.Get("x-address"), "address", t)
+	assert.Equal("example.org", e.Header.Get("x-domain"), "domain", t)
+	assert.Equal("JO SMITH", e.Header.Get("x-name"), "name", t)
+	assert.Equal("Re: hi", e.Header.Get("x-subject"), "replace", t)
+	assert.Equal("from-env", e.Header.Get("x-env"), "env", t)
+	assert.Equal(4, len(e.Header.Get("x-year")), "now", t)
+	var uuidRE = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	assert.True(uuidRE.MatchString(e.Header.Get("x-id")), "uuid "+e.Header.Get("x-id"), t)
+}
+
+func TestTemplateData(t *testing.T) {
+	var e = email.New()
+	e.Header.Set("from", "Me <me@example.org>")
+	e.Header.Set("to", "a@example.org, B <b@example.org>")
+	e.Envelope.From = "bounces@example.org"
+	e.Envelope.To = []string{"a@example.org", "b@example.org"}
+
+	var r = mkActRule(t,
+		`SetHeader X-Rule:{{.Rule}}`,
+		`SetHeader X-Var:{{.Vars.site}}`,
+		`SetHeader X-Env-From:{{.Envelope.From}}`,
+		`SetHeader X-Env-To:{{range .Envelope.To}}<{{.}}>{{end}}`,
+		`SetHeader X-From:{{.Header.Get "from"}}`,
+		`SetHeader X-Address:{{(.Address "from").Address}}`,
+		`SetHeader X-To:{{range .AddressList "to"}}[{{.Address}}]{{end}}`,
+		`SetHeader X-Values:{{index (.Values "from") 0}}`,
+	)
+	r.Name = "tagging"
+	r.Vars = map[string]string{"site": "www"}
+	r.Apply(e)
+	assert.Equal("tagging", e.Header.Get("x-rule"), "rule name", t)
+	assert.Equal("www", e.Header.Get("x-var"), "config var", t)
+	assert.Equal("bounces@example.org", e.Header.Get("x-env-from"), "envelope sender", t)
+	assert.Equal("<a@example.org><b@example.org>", e.Header.Get("x-env-to"), "envelope recipients", t)
+	assert.Equal("Me <me@example.org>", e.Header.Get("x-from"), "header", t)
+	assert.Equal("me@example.org", e.Header.Get("x-address"), "header's Address method", t)
+	assert.Equal("[a@example.org][b@example.org]", e.Header.Get("x-to"), "header's AddressList method", t)
+	assert.Equal("Me <me@example.org>", e.Header.Get("x-values"), "header's Values method", t)
+}
+
+func TestTemplateMissingKeys(t *testing.T) {
+	var e = email.New()
+	var r = mkActRule(t, `SetHeader X-Var:[{{.Vars.nope}}]`, `SetHeader X-Capture:[{{.Captures.nope}}]`)
+	r.Vars = map[string]string{"site": "www"}
+	r.ApplyCaptures(e, Captures{"user": "jo"})
+	assert.Equal("[]", e.Header.Get("x-var"), "missing var renders empty", t)
+	assert.Equal("[]", e.Header.Get("x-capture"), "missing capture renders empty", t)
+
+	// Without any vars or captures at all, the result is the same
+	e = email.New()
+	r.Vars = nil
+	r.Apply(e)
+	assert.Equal("[]", e.Header.Get("x-var"), "var with no vars renders empty", t)
+	assert.Equal("[]", e.Header.Get("x-capture"), "capture with no captures renders empty", t)
+}
+
+func TestTemplateErrorsAreLogged(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	var e = email.New()
+	var r = mkActRule(t, `SetHeader X-Bad:before-{{index .Vars.list 3}}`)
+	r.Name = "broken"
+	r.Apply(e)
+	assert.Equal("before-", e.Header.Get("x-bad"), "output before the failure is kept", t)
+	assert.True(strings.Contains(buf.String(), "rule broken"), "error is logged: "+buf.String(), t)
+	assert.True(strings.Contains(buf.String(), "SetHeader"), "error names the action: "+buf.String(), t)
+}
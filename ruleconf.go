@@ -1,47 +1,666 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/Nerdmaster/sendmail/email"
 	"github.com/Nerdmaster/sendmail/rule"
+	"github.com/Nerdmaster/sendmail/smtpauth"
 )
 
 type authentication struct {
+	// Transport names a profile from the config's transports section.  Its
+	// settings are used for any fields which aren't set here.  A name with a
+	// template in it, e.g., "relay-{{.Captures.domain}}", is rendered for
+	// each message to choose the transport.
+	Transport string
+
 	Host     string
 	Username string
 	Password string
 	Server   string
+
+	// Alternatives to an inline password: a file holding it, an environment
+	// variable, or a command which prints it.  Only one may be set.
+	PasswordFile    string `yaml:"password_file"`
+	PasswordEnv     string `yaml:"password_env"`
+	PasswordCommand string `yaml:"password_command"`
+
+	// Timeout limits how long connecting to Server, or waiting on it once
+	// connected, may take, so a dead server doesn't hold up failover to the
+	// next one
+	Timeout time.Duration
+
+	// Mechanism is the SMTP auth mechanism: plain, login, cram-md5, xoauth2, or
+	// none.  If empty, one is chosen from what the server offers.  It's
+	// lowercased when the config is loaded, so "None" is the same as "none".
+	Mechanism    string
+	TokenFile    string `yaml:"token_file"`
+	TokenCommand string `yaml:"token_command"`
+
+	// TLS settings for the connection to Server.  InsecureSkipVerify is a
+	// pointer so a rule can turn it back off for a transport which sets it.
+	TLS                string `yaml:"tls"`
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	MinTLSVersion      string `yaml:"min_tls_version"`
+	InsecureSkipVerify *bool  `yaml:"insecure_skip_verify"`
+
+	dialer *email.Dialer
+
+	// The password is only looked up once per process.  Settings merged with
+	// a transport use the transport's password unless they set their own, and
+	// secretOwner points at the transport so they share its lookup.
+	secretMu    sync.Mutex
+	secret      *string
+	secretOwner *authentication
+
+	// transportTmpl is set when Transport is a template, and resolved caches
+	// the settings for each transport it has chosen
+	transportTmpl *rule.Template
+	transports    map[string]*authentication
+	resolvedMu    sync.Mutex
+	resolved      map[string]*authentication
+}
+
+// password returns the password from wherever it's configured.  The first
+// successful lookup is cached, so files and commands are only read once.
+func (a *authentication) password() (string, error) {
+	if a.secretOwner != nil {
+		return a.secretOwner.password()
+	}
+
+	a.secretMu.Lock()
+	defer a.secretMu.Unlock()
+	if a.secret != nil {
+		return *a.secret, nil
+	}
+
+	var pw string
+	switch {
+	case a.PasswordFile != "":
+		var data, err = ioutil.ReadFile(a.PasswordFile)
+		if err != nil {
+			return "", err
+		}
+		pw = strings.TrimRight(string(data), "\r\n")
+	case a.PasswordEnv != "":
+		var val, ok = os.LookupEnv(a.PasswordEnv)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", a.PasswordEnv)
+		}
+		pw = val
+	case a.PasswordCommand != "":
+		var out, err = exec.Command("/bin/sh", "-c", a.PasswordCommand).Output()
+		if err != nil {
+			return "", fmt.Errorf("password_command failed: %s", err)
+		}
+		pw = strings.TrimRight(string(out), "\r\n")
+	default:
+		pw = a.Password
+	}
+
+	a.secret = &pw
+	return pw, nil
+}
+
+// passwordSources returns how many ways the password has been configured
+func (a *authentication) passwordSources() int {
+	var n int
+	for _, s := range []string{a.Password, a.PasswordFile, a.PasswordEnv, a.PasswordCommand} {
+		if s != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// token returns the XOAUTH2 token from the configured file or command.  As
+// with passwords, a failed lookup is a temporary error.
+func (a *authentication) token() (string, error) {
+	var data []byte
+	var err error
+	if a.TokenFile != "" {
+		data, err = ioutil.ReadFile(a.TokenFile)
+	} else {
+		data, err = exec.Command("/bin/sh", "-c", a.TokenCommand).Output()
+	}
+	return strings.TrimSpace(string(data)), email.Temporary(err)
+}
+
+// initAuth validates the auth mechanism and password settings.  This must be
+// called after initDialer, as sending credentials in the clear is only
+// allowed when TLS has explicitly been turned off.  The password itself isn't
+// looked up until it's needed.
+func (a *authentication) initAuth() error {
+	if a.passwordSources() > 1 {
+		return errors.New("only one of password, password_file, password_env, and password_command may be set")
+	}
+	var _, err = a.newAuth("")
+	return err
+}
+
+// newAuth returns a new smtp.Auth for the configured mechanism.  Some
+// mechanisms keep state during authentication, so each connection needs its
+// own.
+func (a *authentication) newAuth(password string) (smtp.Auth, error) {
+	var c = smtpauth.Credentials{
+		Host:          a.Host,
+		Username:      a.Username,
+		Password:      password,
+		AllowInsecure: a.dialer.TLS == email.TLSNone,
+	}
+	if a.TokenFile != "" || a.TokenCommand != "" {
+		c.Token = a.token
+	}
+
+	return smtpauth.New(a.Mechanism, c)
 }
 
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// initDialer sets up the email.Dialer used to talk to the SMTP server, adding
+// the default port to Server if it doesn't have one
+func (a *authentication) initDialer() error {
+	var mode, err = email.ParseTLSMode(a.TLS)
+	if err != nil {
+		return err
+	}
+
+	var _, _, splitErr = net.SplitHostPort(a.Server)
+	if splitErr != nil {
+		a.Server = net.JoinHostPort(a.Server, mode.DefaultPort())
+	}
+
+	var cfg = &tls.Config{InsecureSkipVerify: a.InsecureSkipVerify != nil && *a.InsecureSkipVerify}
+	if a.MinTLSVersion != "" {
+		var v, ok = tlsVersions[a.MinTLSVersion]
+		if !ok {
+			return fmt.Errorf("unknown min_tls_version %q", a.MinTLSVersion)
+		}
+		cfg.MinVersion = v
+	}
+
+	if a.CAFile != "" {
+		var pem []byte
+		pem, err = ioutil.ReadFile(a.CAFile)
+		if err != nil {
+			return fmt.Errorf("unable to read ca_file: %s", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in ca_file %q", a.CAFile)
+		}
+	}
+
+	if a.CertFile != "" || a.KeyFile != "" {
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(a.CertFile, a.KeyFile)
+		if err != nil {
+			return fmt.Errorf("unable to load client certificate: %s", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	a.dialer = &email.Dialer{TLS: mode, TLSConfig: cfg, Timeout: a.Timeout}
+	return nil
+}
+
+// withTransport returns a new authentication with a's settings, falling back
+// to t's for any a doesn't set.  A field is only unset when it has its zero
+// value, so settings which need an explicit "off", like insecure_skip_verify,
+// are pointers.
+func (a *authentication) withTransport(t *authentication) *authentication {
+	var merged = new(authentication)
+	var dst, override, base = reflect.ValueOf(merged).Elem(), reflect.ValueOf(a).Elem(), reflect.ValueOf(t).Elem()
+	for i := 0; i < dst.NumField(); i++ {
+		var f = dst.Field(i)
+		if !f.CanSet() {
+			continue
+		}
+		if override.Field(i).IsZero() {
+			f.Set(base.Field(i))
+		} else {
+			f.Set(override.Field(i))
+		}
+	}
+
+	// A password or token source in a replaces t's, rather than conflicting
+	if a.passwordSources() > 0 {
+		merged.Password, merged.PasswordFile = a.Password, a.PasswordFile
+		merged.PasswordEnv, merged.PasswordCommand = a.PasswordEnv, a.PasswordCommand
+	} else {
+		merged.secretOwner = t
+	}
+	if a.TokenFile != "" || a.TokenCommand != "" {
+		merged.TokenFile, merged.TokenCommand = a.TokenFile, a.TokenCommand
+	}
+	return merged
+}
+
+// forMessage returns the settings to send the email with: a itself, or if
+// its transport is a template, a's settings merged with the transport the
+// template chooses
+func (a *authentication) forMessage(r *rule.Rule, e *email.Email, caps rule.Captures) (*authentication, error) {
+	if a.transportTmpl == nil {
+		return a, nil
+	}
+	var name, err = r.Render(a.transportTmpl, e, caps)
+	if err != nil {
+		return nil, fmt.Errorf("unable to choose a transport from %q: %s", a.transportTmpl, err)
+	}
+
+	a.resolvedMu.Lock()
+	defer a.resolvedMu.Unlock()
+	if a.resolved[name] != nil {
+		return a.resolved[name], nil
+	}
+	var t = a.transports[name]
+	if t == nil {
+		return nil, fmt.Errorf("unknown transport %q (chosen by %q)", name, a.transportTmpl)
+	}
+
+	var merged = a.withTransport(t)
+	merged.Transport = name
+	if merged.Server == "" {
+		return nil, fmt.Errorf("transport %q has no server", name)
+	}
+	err = merged.initDialer()
+	if err == nil {
+		err = merged.initAuth()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth settings for transport %q: %s", name, err)
+	}
+	if a.resolved == nil {
+		a.resolved = make(map[string]*authentication)
+	}
+	a.resolved[name] = merged
+	return merged, nil
+}
+
+// send delivers the email via this server with its credentials
+func (a *authentication) send(e *email.Email) error {
+	var pw string
+	var err error
+	if a.Mechanism != "none" {
+		pw, err = a.password()
+		if err != nil {
+			// The lookup may work next time (the file may just be missing while
+			// it's rotated, say), so the message is queued rather than dropped
+			return email.Temporary(fmt.Errorf("unable to get password for server %q: %s", a.Server, err))
+		}
+	}
+
+	e.Auth, err = a.newAuth(pw)
+	if err != nil {
+		return err
+	}
+	e.Mailer = a.dialer.SendMail
+	return e.Send(a.Server)
+}
+
+// authList holds one or more servers to try in order.  In the YAML, "auth"
+// can be a single server's settings or a list of them.
+type authList []*authentication
+
+// UnmarshalYAML implements yaml.Unmarshaler to allow a single auth block in
+// place of a list
+func (l *authList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw interface{}
+	var err = unmarshal(&raw)
+	if err != nil {
+		return err
+	}
+
+	if _, isList := raw.([]interface{}); isList {
+		var list []*authentication
+		err = unmarshal(&list)
+		*l = list
+		return err
+	}
+
+	var a = new(authentication)
+	err = unmarshal(a)
+	*l = authList{a}
+	return err
+}
+
+// matcherConf is one entry in a rule's matchers: a matcher string, or a
+// group of entries under a single "all", "any", or "not" key
+type matcherConf struct {
+	condition string
+	op        string
+	members   matcherList
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler to allow either a string or a
+// group in each matchers entry
+func (m *matcherConf) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if unmarshal(&m.condition) == nil {
+		return nil
+	}
+
+	var group map[string]matcherList
+	var err = unmarshal(&group)
+	if err != nil {
+		return err
+	}
+	if len(group) != 1 {
+		return fmt.Errorf("a matcher group must have exactly one key: %q, %q, or %q", rule.All, rule.Any, rule.Not)
+	}
+	for op, members := range group {
+		m.op, m.members = op, members
+	}
+	return nil
+}
+
+// String returns the matcher string, or a compact form of the group for
+// messages and comparisons, e.g., "any(From:a@example.org, From:b@example.org)"
+func (m matcherConf) String() string {
+	if m.op == "" {
+		return m.condition
+	}
+	return m.op + "(" + m.members.String() + ")"
+}
+
+// addTo adds the matcher or group to g, returning every problem found
+func (m matcherConf) addTo(r *RuleConf, g matcherAdder) []error {
+	if m.op == "" {
+		// YAML reads an unquoted "!X-Test:yes" as a tag on an empty value
+		if m.condition == "" {
+			return []error{r.errorf("!", `empty rule matcher: a matcher starting with "!" must be quoted, e.g., "!X-Test:yes"`)}
+		}
+		var err = g.AddMatcher(m.condition)
+		if err != nil {
+			return []error{r.errorf(m.condition, "invalid rule matcher string (%s): %s", m.condition, err)}
+		}
+		return nil
+	}
+
+	var sub, err = g.AddGroup(m.op)
+	if err != nil {
+		return []error{r.errorf(m.op+":", "invalid matcher group: %s", err)}
+	}
+	if len(m.members) == 0 {
+		return []error{r.errorf(m.op+":", "%q matcher group is empty", m.op)}
+	}
+	var errs []error
+	for _, member := range m.members {
+		errs = append(errs, member.addTo(r, sub)...)
+	}
+	return errs
+}
+
+// matcherAdder is a rule.Rule or rule.Group
+type matcherAdder interface {
+	AddMatcher(condition string) error
+	AddGroup(op string) (*rule.Group, error)
+}
+
+// matcherList holds a rule's or group's matchers.  In the YAML, a group's
+// members can be a single entry in place of a list.
+type matcherList []matcherConf
+
+// UnmarshalYAML implements yaml.Unmarshaler to allow a single entry in place
+// of a list
+func (l *matcherList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []matcherConf
+	if unmarshal(&list) == nil {
+		*l = list
+		return nil
+	}
+
+	var m matcherConf
+	var err = unmarshal(&m)
+	*l = matcherList{m}
+	return err
+}
+
+func (l matcherList) String() string {
+	var strs = make([]string, len(l))
+	for i, m := range l {
+		strs[i] = m.String()
+	}
+	return strings.Join(strs, ", ")
+}
+
+// Values for a rule's on_permanent_error and on_temporary_error settings
+const (
+	failoverStop = "stop"
+	failoverNext = "next"
+)
+
 // RuleConf is a config-friendly composition for making config strings turn into
 // rule.Rules and living alongside the smtp auth we need for sending emails
 type RuleConf struct {
 	rule     *rule.Rule
-	Matchers []string
+	src      *configSource
+	line     int
+	endLine  int
+	Matchers matcherList
 	Actions  []string
-	Auth     *authentication
+	Auth     authList
+
+	// Name is optional, and is shown by test-rules and given to action
+	// templates as {{.Rule}}
+	Name string
+
+	// Transport names the profile used for sending.  It's shorthand for an auth
+	// section naming the transport, and applies to any auth entries which
+	// don't name their own, so they can override its settings.
+	Transport string
+
+	// Continue makes the rule's actions apply without ending the search: the
+	// message goes on to be matched against later rules, and is sent by the
+	// first matching rule which doesn't continue
+	Continue bool
+
+	// Include makes this list entry a directive rather than a rule: the
+	// rules from the named file, directory, or glob are inserted in its place
+	Include string
+
+	// What to do when a server fails: "stop" gives up (queueing the message if
+	// the error was temporary), and "next" tries the next server in Auth.  By
+	// default a permanent (5xx) error stops, while temporary (4xx) and
+	// connection errors try the next server.
+	OnPermanentError string `yaml:"on_permanent_error"`
+	OnTemporaryError string `yaml:"on_temporary_error"`
+}
+
+// resolveTransports replaces each auth entry which names a transport with
+// the transport's settings, overridden by any the entry sets itself
+func (r *RuleConf) resolveTransports(transports map[string]*authentication) []error {
+	if r.Transport != "" {
+		if len(r.Auth) == 0 {
+			r.Auth = authList{new(authentication)}
+		}
+		for _, a := range r.Auth {
+			if a.Transport == "" {
+				a.Transport = r.Transport
+			}
+		}
+	}
+
+	var errs []error
+	for i, a := range r.Auth {
+		if a.Transport == "" {
+			continue
+		}
+		if strings.Contains(a.Transport, "{{") {
+			var tmpl, err = rule.NewTemplate(a.Transport)
+			if err != nil {
+				errs = append(errs, r.errorf(a.Transport, "invalid transport template %q: %s", a.Transport, err))
+				continue
+			}
+			a.transportTmpl, a.transports = tmpl, transports
+			continue
+		}
+		var t, ok = transports[a.Transport]
+		if !ok {
+			errs = append(errs, r.errorf(a.Transport, "unknown transport %q", a.Transport))
+			continue
+		}
+		r.Auth[i] = a.withTransport(t)
+	}
+	return errs
 }
 
-func (r *RuleConf) initRule() {
-	r.rule = new(rule.Rule)
-	for _, mstr := range r.Matchers {
-		var err = r.rule.AddMatcher(mstr)
+// initRule validates the rule's settings and creates its concrete rule.Rule,
+// returning all problems found rather than stopping at the first
+func (r *RuleConf) initRule(transports map[string]*authentication, vars map[string]string) []error {
+	var errs []error
+	if r.Continue && (len(r.Auth) > 0 || r.Transport != "") {
+		errs = append(errs, r.errorf("continue", "continue rules can't have an auth section or transport"))
+	}
+	errs = append(errs, r.resolveTransports(transports)...)
+	for _, a := range r.Auth {
+		// Unknown transports have already been reported, and templated ones
+		// are checked when they're used
+		if a.Transport != "" && transports[a.Transport] == nil {
+			continue
+		}
+		if a.Server == "" {
+			errs = append(errs, r.errorf("auth", "auth section has no server"))
+			continue
+		}
+		var err = a.initDialer()
+		if err == nil {
+			err = a.initAuth()
+		}
 		if err != nil {
-			log.Fatalf("Invalid rule matcher string (%s): %s", mstr, err)
+			errs = append(errs, r.errorf(a.Server, "invalid auth settings for server %q: %s", a.Server, err))
 		}
 	}
+
+	if r.OnPermanentError == "" {
+		r.OnPermanentError = failoverStop
+	}
+	if r.OnTemporaryError == "" {
+		r.OnTemporaryError = failoverNext
+	}
+	for _, val := range []string{r.OnPermanentError, r.OnTemporaryError} {
+		if val != failoverStop && val != failoverNext {
+			errs = append(errs, r.errorf(val, "invalid failover setting %q: must be %q or %q", val, failoverStop, failoverNext))
+		}
+	}
+
+	r.rule = &rule.Rule{Name: r.Name, Vars: vars}
+	for _, m := range r.Matchers {
+		errs = append(errs, m.addTo(r, r.rule)...)
+	}
 	for _, astr := range r.Actions {
 		var err = r.rule.AddAction(astr)
 		if err != nil {
-			log.Fatalf("Invalid rule action string (%s): %s", astr, err)
+			errs = append(errs, r.errorf(astr, "invalid rule action string (%s): %s", astr, err))
 		}
 	}
+
+	// Rules which discard or reject everything they match never send mail, and
+	// continue rules leave sending to a later rule
+	var d, _ = r.rule.Disposition()
+	if r.Continue && d != rule.Deliver {
+		errs = append(errs, r.errorf("continue", "continue rules can't Discard, Reject, or Defer"))
+	}
+	if len(r.Auth) == 0 && !r.Continue && d != rule.Discard && d != rule.Reject {
+		errs = append(errs, r.errorf("", "rule has no auth section or transport"))
+	}
+
+	return errs
+}
+
+// send delivers the email using this rule's servers, trying each in turn
+// until one succeeds or an error's failover setting says to stop.  The last
+// error is returned if no server accepted the message.  caps holds the rule's
+// regex captures, for transport templates.
+func (r *RuleConf) send(e *email.Email, caps rule.Captures) error {
+	var err error
+	for i, entry := range r.Auth {
+		var a *authentication
+		a, err = entry.forMessage(r.rule, e, caps)
+		if err != nil {
+			if r.OnPermanentError != failoverNext {
+				break
+			}
+			continue
+		}
+		if opts.Verbose {
+			log.Printf("DEBUG: Sending via %q (server %d of %d)", a.Server, i+1, len(r.Auth))
+		}
+		err = a.send(e)
+		if err == nil {
+			return nil
+		}
+
+		var next = r.OnPermanentError == failoverNext
+		if email.IsTemporary(err) {
+			next = r.OnTemporaryError == failoverNext
+		}
+		if opts.Verbose {
+			log.Printf("DEBUG: Server %q failed: %s", a.Server, err)
+		}
+		if !next {
+			break
+		}
+	}
+
+	return err
 }
 
 // initRules takes the configuration parts of the RuleConf and creates the
-// concrete rule.Rule definitions
-func initRules(rlist []*RuleConf) {
+// concrete rule.Rule definitions, returning any problems found
+func initRules(rlist []*RuleConf, transports map[string]*authentication, vars map[string]string) []error {
+	var errs []error
+	var names = make(map[string]*RuleConf)
 	for _, r := range rlist {
-		r.initRule()
+		errs = append(errs, r.initRule(transports, vars)...)
+		if r.Name == "" {
+			continue
+		}
+		if names[r.Name] != nil {
+			errs = append(errs, r.errorf("name", "rule name %q is already used at %s", r.Name, names[r.Name].location()))
+		}
+		names[r.Name] = r
+	}
+	return errs
+}
+
+// id identifies the rule in queue entries, so retries go through the same
+// rule even after the config is reordered: the rule's name if it has one,
+// otherwise its matchers and where it sends mail
+func (r *RuleConf) id() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	var via []string
+	for _, a := range r.Auth {
+		switch {
+		case a.transportTmpl != nil:
+			via = append(via, a.transportTmpl.String())
+		case a.Username != "":
+			via = append(via, a.Username+"@"+a.Server)
+		default:
+			via = append(via, a.Server)
+		}
 	}
+	return fmt.Sprintf("%s via %s", r.Matchers, strings.Join(via, ", "))
 }
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Nerdmaster/sendmail/email"
+	"github.com/uoregon-libraries/gopkg/assert"
+)
+
+func TestPasswordSources(t *testing.T) {
+	var dir = mkconfig(t, map[string]string{"pw": "from-file\n"})
+
+	var a = &authentication{Password: "inline"}
+	var pw, err = a.password()
+	assert.NilError(err, "inline password", t)
+	assert.Equal("inline", pw, "inline password", t)
+
+	a = &authentication{PasswordFile: filepath.Join(dir, "pw")}
+	pw, err = a.password()
+	assert.NilError(err, "password_file", t)
+	assert.Equal("from-file", pw, "password_file is read without its trailing newline", t)
+
+	os.Setenv("SENDMAIL_TEST_PASSWORD", "from-env")
+	a = &authentication{PasswordEnv: "SENDMAIL_TEST_PASSWORD"}
+	pw, err = a.password()
+	assert.NilError(err, "password_env", t)
+	assert.Equal("from-env", pw, "password_env", t)
+
+	a = &authentication{PasswordEnv: "SENDMAIL_TEST_UNSET_PASSWORD"}
+	_, err = a.password()
+	assert.True(err != nil, "unset password_env is an error", t)
+
+	a = &authentication{PasswordCommand: "echo from-command"}
+	pw, err = a.password()
+	assert.NilError(err, "password_command", t)
+	assert.Equal("from-command", pw, "password_command", t)
+
+	a = &authentication{PasswordCommand: "exit 1"}
+	_, err = a.password()
+	assert.True(err != nil, "failing password_command is an error", t)
+}
+
+func TestPasswordCaching(t *testing.T) {
+	var dir = mkconfig(t, map[string]string{})
+	var count = filepath.Join(dir, "count")
+	var a = &authentication{PasswordCommand: "echo run >> " + count + " && echo secret"}
+
+	for i := 0; i < 3; i++ {
+		var pw, err = a.password()
+		assert.NilError(err, "password_command", t)
+		assert.Equal("secret", pw, "password", t)
+	}
+	var data, _ = ioutil.ReadFile(count)
+	assert.Equal(1, strings.Count(string(data), "run"), "command only runs once", t)
+
+	// A failed lookup isn't cached, so it's tried again next time
+	var pwFile = filepath.Join(dir, "pw")
+	a = &authentication{PasswordFile: pwFile}
+	var _, err = a.password()
+	assert.True(err != nil, "missing password_file is an error", t)
+	ioutil.WriteFile(pwFile, []byte("late"), 0600)
+	var pw string
+	pw, err = a.password()
+	assert.NilError(err, "password_file after it's written", t)
+	assert.Equal("late", pw, "password_file after it's written", t)
+}
+
+func TestPasswordFailureIsTemporary(t *testing.T) {
+	var a = &authentication{Server: "localhost:25", PasswordFile: "/nonexistent/go-sendmail.pass"}
+	var err = a.send(email.New())
+	assert.True(err != nil, "send fails without a password", t)
+	assert.True(email.IsTemporary(err), "password lookup failure is temporary: "+err.Error(), t)
+}
+
+func TestWithTransport(t *testing.T) {
+	var yes, no = true, false
+	var transport = &authentication{
+		Host:               "example.com",
+		Username:           "relay",
+		PasswordEnv:        "SENDMAIL_TEST_RELAY_PASSWORD",
+		Server:             "relay.example.com:587",
+		Mechanism:          "plain",
+		TLS:                "starttls",
+		InsecureSkipVerify: &yes,
+	}
+
+	var merged = (&authentication{Transport: "relay", Username: "me"}).withTransport(transport)
+	assert.Equal("me", merged.Username, "setting given by the rule", t)
+	assert.Equal("relay.example.com:587", merged.Server, "setting from the transport", t)
+	assert.Equal("SENDMAIL_TEST_RELAY_PASSWORD", merged.PasswordEnv, "password from the transport", t)
+	assert.True(*merged.InsecureSkipVerify, "insecure_skip_verify from the transport", t)
+
+	merged = (&authentication{InsecureSkipVerify: &no, PasswordFile: "/etc/pw"}).withTransport(transport)
+	assert.False(*merged.InsecureSkipVerify, "rule can turn insecure_skip_verify off", t)
+	assert.Equal("/etc/pw", merged.PasswordFile, "rule's password source", t)
+	assert.Equal("", merged.PasswordEnv, "rule's password source replaces the transport's", t)
+	assert.Equal(1, merged.passwordSources(), "only one password source", t)
+}
+
+func TestTransportSharesPassword(t *testing.T) {
+	var dir = mkconfig(t, map[string]string{})
+	var count = filepath.Join(dir, "count")
+	var transport = &authentication{Server: "relay.example.com:587", PasswordCommand: "echo run >> " + count + " && echo secret"}
+
+	for i := 0; i < 3; i++ {
+		var merged = (&authentication{Transport: "relay"}).withTransport(transport)
+		var pw, err = merged.password()
+		assert.NilError(err, "password via the transport", t)
+		assert.Equal("secret", pw, "password via the transport", t)
+	}
+	var data, _ = ioutil.ReadFile(count)
+	assert.Equal(1, strings.Count(string(data), "run"), "rules using a transport share its password lookup", t)
+}
+
+// mkFailoverRule returns a rule which sends through each server in order,
+// with the given extra settings
+func mkFailoverRule(t *testing.T, settings string, servers ...*fakeServer) *RuleConf {
+	var data = "- matchers: [\"*\"]\n" + settings + "  auth:\n"
+	for _, fs := range servers {
+		data += fmt.Sprintf("    - {server: %q, mechanism: none, tls: none}\n", fs.addr)
+	}
+	return mkrules(t, data)[0]
+}
+
+func TestFailover(t *testing.T) {
+	var tempFail, permFail, ok = newFakeServer(t), newFakeServer(t), newFakeServer(t)
+	tempFail.reply, permFail.reply = 451, 550
+	var e = mkemail(t, "a@example.org")
+
+	var r = mkFailoverRule(t, "", tempFail, ok)
+	assert.NilError(r.send(e, nil), "a temporary failure moves on to the next server", t)
+	assert.Equal("a@example.org", ok.recipients(), "next server got the message", t)
+
+	ok = newFakeServer(t)
+	r = mkFailoverRule(t, "", permFail, ok)
+	var err = r.send(e, nil)
+	assert.True(err != nil, "a permanent failure stops by default", t)
+	assert.False(email.IsTemporary(err), "the permanent failure is returned", t)
+	assert.Equal("", ok.recipients(), "next server isn't tried", t)
+
+	r = mkFailoverRule(t, "  on_permanent_error: next\n", permFail, ok)
+	assert.NilError(r.send(e, nil), "on_permanent_error: next moves on", t)
+	assert.Equal("a@example.org", ok.recipients(), "next server got the message", t)
+
+	ok = newFakeServer(t)
+	r = mkFailoverRule(t, "  on_temporary_error: stop\n", tempFail, ok)
+	err = r.send(e, nil)
+	assert.True(email.IsTemporary(err), "on_temporary_error: stop returns the temporary failure", t)
+	assert.Equal("", ok.recipients(), "next server isn't tried", t)
+
+	r = mkFailoverRule(t, "", tempFail, tempFail)
+	err = r.send(e, nil)
+	assert.True(err != nil, "every server failing is an error", t)
+	assert.True(email.IsTemporary(err), "a final temporary failure is temporary", t)
+}
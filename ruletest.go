@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Nerdmaster/sendmail/email"
+	"github.com/Nerdmaster/sendmail/rule"
+)
+
+// readTestEmail builds the email for rule testing from --header flags if any
+// were given, otherwise from stdin
+func readTestEmail() (*email.Email, error) {
+	if len(opts.Headers) == 0 {
+		if opts.IgnoreDots {
+			return email.ReadIgnoringDots(os.Stdin)
+		}
+		return email.Read(os.Stdin)
+	}
+
+	var data = strings.Join(opts.Headers, "\r\n") + "\r\n\r\n"
+	return email.ReadIgnoringDots(strings.NewReader(data))
+}
+
+// headerLines returns the email's header as written for sending, one field
+// per line
+func headerLines(e *email.Email) []string {
+	var b bytes.Buffer
+	e.Header.Write(&b)
+	if b.Len() == 0 {
+		return nil
+	}
+	return strings.Split(b.String(), "\r\n")
+}
+
+// diffLines returns the lines in a which aren't in b
+func diffLines(a, b []string) []string {
+	var seen = make(map[string]bool)
+	for _, l := range b {
+		seen[l] = true
+	}
+	var diff []string
+	for _, l := range a {
+		if !seen[l] {
+			diff = append(diff, l)
+		}
+	}
+	return diff
+}
+
+// testRules explains how each rule evaluates against a message, and what the
+// winning rule would do to it, without sending anything
+func testRules(rules []*RuleConf, args []string) {
+	var e, err = readTestEmail()
+	if err != nil {
+		log.Fatalf("Unable to read message: %s", err)
+	}
+	applyArgs(e, args)
+
+	var winner = -1
+	var chain []ruleMatch
+	for i, r := range rules {
+		var matched, caps = r.rule.MatchCaptures(e)
+		var status = "no match"
+		switch {
+		case matched && winner == -1 && r.Continue:
+			chain = append(chain, ruleMatch{index: i, captures: caps})
+			status = "MATCH (actions apply; continuing)"
+		case matched && winner == -1:
+			winner = i
+			chain = append(chain, ruleMatch{index: i, captures: caps})
+			status = "MATCH (selected)"
+		case matched:
+			status = "match (not reached; an earlier rule was selected)"
+		}
+		if r.Name != "" {
+			fmt.Printf("Rule %d (%s): %s\n", i, r.Name, status)
+		} else {
+			fmt.Printf("Rule %d: %s\n", i, status)
+		}
+		if len(r.Matchers) == 0 {
+			fmt.Println("  (no matchers; this rule can never match)")
+		}
+
+		for _, result := range r.rule.Explain(e) {
+			var mark = "fail"
+			if result.Matched {
+				mark = "pass"
+			}
+			var indent = strings.Repeat("  ", result.Depth)
+			if result.Group {
+				fmt.Printf("  %s[%s] %s\n", indent, mark, result.Matcher)
+				continue
+			}
+			var val = "(no value)"
+			if result.HasValue {
+				val = fmt.Sprintf("%q", result.Value)
+			}
+			if strings.TrimPrefix(result.Matcher, "!") == "*" {
+				val = "(catch-all)"
+			}
+			fmt.Printf("  %s[%s] %s: %s\n", indent, mark, result.Matcher, val)
+		}
+		if len(caps) > 0 {
+			fmt.Printf("  Captures: %s\n", formatCaptures(caps))
+		}
+	}
+
+	if splitRecipients {
+		testSplit(rules, e)
+		return
+	}
+
+	if winner == -1 {
+		fmt.Println("\nNo rules matched; the message would be rejected")
+		return
+	}
+
+	fmt.Printf("\nSelected rule %d\n", winner)
+	showDelivery(rules, chain, e)
+}
+
+// testSplit explains how split delivery would divide up the message's
+// recipients, and what each group's rule would do
+func testSplit(rules []*RuleConf, e *email.Email) {
+	var groups, unmatched, err = groupRecipients(rules, e)
+	if err != nil {
+		fmt.Printf("\nUnable to split recipients: %s\n", err)
+		return
+	}
+
+	for _, g := range groups {
+		var part = e.Clone()
+		part.Envelope.To = g.rcpts
+		fmt.Printf("\nSplit delivery: rule %d for %s\n", g.chain[len(g.chain)-1].index, strings.Join(g.rcpts, ", "))
+		showDelivery(rules, g.chain, part)
+	}
+	if len(unmatched) > 0 {
+		fmt.Printf("\nNo rules matched %s; they would be rejected\n", strings.Join(unmatched, ", "))
+	}
+}
+
+// showDelivery prints what the actions of the chain of matched rules would do
+// to the email, and where the last rule would send it unless it discards or
+// rejects it
+func showDelivery(rules []*RuleConf, chain []ruleMatch, e *email.Email) {
+	var applied = e.Clone()
+	var continued []string
+	for _, m := range chain {
+		var err = rules[m.index].rule.ApplyCaptures(applied, m.captures)
+		if err != nil {
+			fmt.Printf("Disposition: delivery fails: rule %d: %s\n", m.index, err)
+			return
+		}
+		continued = append(continued, strconv.Itoa(m.index))
+	}
+	var last = chain[len(chain)-1]
+	var r = rules[last.index]
+	if len(chain) > 1 {
+		fmt.Printf("Actions from continuing rules: %s\n", strings.Join(continued[:len(chain)-1], ", "))
+	}
+
+	fmt.Println("Header changes:")
+	var before, after = headerLines(e), headerLines(applied)
+	var removed, added = diffLines(before, after), diffLines(after, before)
+	if len(removed) == 0 && len(added) == 0 {
+		fmt.Println("  (none)")
+	}
+	for _, l := range removed {
+		fmt.Printf("  - %s\n", l)
+	}
+	for _, l := range added {
+		fmt.Printf("  + %s\n", l)
+	}
+
+	var disposition, reason = r.rule.Disposition()
+	if disposition != rule.Reject && applied.Envelope.NoRecipients {
+		fmt.Println("Disposition: discarded (every recipient was removed)")
+		return
+	}
+	switch disposition {
+	case rule.Discard:
+		fmt.Println("Disposition: discarded")
+		return
+	case rule.Reject:
+		fmt.Printf("Disposition: rejected (%s)\n", reason)
+		return
+	case rule.Defer:
+		fmt.Println("Disposition: deferred to the queue")
+	}
+
+	var from, fromErr = applied.Sender()
+	var to, toErr = applied.Recipients()
+	fmt.Println("Envelope:")
+	if fromErr != nil {
+		fmt.Printf("  From: error: %s\n", fromErr)
+	} else {
+		fmt.Printf("  From: %s\n", from)
+	}
+	if toErr != nil {
+		fmt.Printf("  To: error: %s\n", toErr)
+	} else {
+		fmt.Printf("  To: %s\n", strings.Join(to, ", "))
+	}
+
+	fmt.Println("Servers:")
+	for _, entry := range r.Auth {
+		var a, err = entry.forMessage(r.rule, applied, last.captures)
+		switch {
+		case err != nil:
+			fmt.Printf("  error: %s\n", err)
+		case entry.transportTmpl != nil:
+			fmt.Printf("  %s (transport %q, chosen by %q)\n", a.Server, a.Transport, entry.transportTmpl)
+		case a.Transport != "":
+			fmt.Printf("  %s (transport %q)\n", a.Server, a.Transport)
+		default:
+			fmt.Printf("  %s\n", a.Server)
+		}
+	}
+}
+
+// formatCaptures lists captures in order: numbered groups, then named groups
+// alphabetically
+func formatCaptures(caps rule.Captures) string {
+	var numbered, named []string
+	for k := range caps {
+		var _, err = strconv.Atoi(k)
+		if err == nil {
+			numbered = append(numbered, k)
+		} else {
+			named = append(named, k)
+		}
+	}
+	sort.Slice(numbered, func(i, j int) bool {
+		var a, _ = strconv.Atoi(numbered[i])
+		var b, _ = strconv.Atoi(numbered[j])
+		return a < b
+	})
+	sort.Strings(named)
+
+	var list []string
+	for _, k := range append(numbered, named...) {
+		list = append(list, fmt.Sprintf("%s=%q", k, caps[k]))
+	}
+	return strings.Join(list, " ")
+}
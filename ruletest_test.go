@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Nerdmaster/sendmail/rule"
+	"github.com/uoregon-libraries/gopkg/assert"
+)
+
+// mkTestRules returns the rules used to test -bt: a continue rule tagging
+// mail to example.org, a rule for subjects with a "[dept]" prefix, and a rule
+// for anything else to example.org
+func mkTestRules(t *testing.T) []*RuleConf {
+	return mkrules(t, ""+
+		"- name: tag\n  matchers: [\"To/domain:example.org\"]\n  continue: true\n"+
+		"  actions: [\"SetHeader X-Tag:tagged\"]\n"+
+		"- name: billing\n  matchers: [\"Subject/regex:^\\\\[(?P<dept>\\\\w+)\\\\]\", {any: [\"From:nobody@example.com\", \"!X-Spam:yes\"]}]\n"+
+		"  actions: [\"DelHeader Subject\", \"SetEnvelopeFrom bounces@example.org\"]\n"+
+		"  auth: {server: \"127.0.0.1:1\", mechanism: none, tls: none}\n"+
+		"- matchers: [\"To/domain:example.org\"]\n  auth: {server: \"127.0.0.1:2\", mechanism: none, tls: none}\n")
+}
+
+// runTestRules runs testRules with the given header lines and returns its
+// output
+func runTestRules(t *testing.T, rules []*RuleConf, headers ...string) string {
+	var saved = opts
+	defer func() { opts = saved }()
+	opts.Headers = headers
+	return captureStdout(t, func() { testRules(rules, nil) })
+}
+
+// assertLines fails the test unless each line is in out
+func assertLines(out string, t *testing.T, lines ...string) {
+	var have = make(map[string]bool)
+	for _, l := range strings.Split(out, "\n") {
+		have[l] = true
+	}
+	for _, l := range lines {
+		assert.True(have[l], "output has "+l+":\n"+out, t)
+	}
+}
+
+func TestTestRulesMatchers(t *testing.T) {
+	var out = runTestRules(t, mkTestRules(t), "From: me@example.com", "To: a@example.org", "Subject: [sales] hi")
+	assertLines(out, t,
+		`Rule 0 (tag): MATCH (actions apply; continuing)`,
+		`  [pass] To/domain:example.org: "a@example.org"`,
+		`Rule 1 (billing): MATCH (selected)`,
+		`  [pass] Subject/regex:^\[(?P<dept>\w+)\]: "[sales] hi"`,
+		`  [pass] any:`,
+		`    [fail] From:nobody@example.com: "me@example.com"`,
+		`  Captures: 1="sales" dept="sales"`,
+		`Rule 2: match (not reached; an earlier rule was selected)`,
+	)
+
+	out = runTestRules(t, mkTestRules(t), "From: me@example.com", "To: a@example.org", "Subject: hi")
+	assertLines(out, t,
+		`Rule 1 (billing): no match`,
+		`  [fail] Subject/regex:^\[(?P<dept>\w+)\]: "hi"`,
+		`Rule 2: MATCH (selected)`,
+	)
+}
+
+func TestTestRulesDelivery(t *testing.T) {
+	var out = runTestRules(t, mkTestRules(t), "From: me@example.com", "To: a@example.org", "Subject: [sales] hi")
+	assertLines(out, t,
+		`Selected rule 1`,
+		`Actions from continuing rules: 0`,
+		`Header changes:`,
+		`  - Subject: [sales] hi`,
+		`  + X-Tag: tagged`,
+		`Envelope:`,
+		`  From: bounces@example.org`,
+		`  To: a@example.org`,
+		`Servers:`,
+		`  127.0.0.1:1`,
+	)
+
+	out = runTestRules(t, mkTestRules(t), "From: me@example.com", "To: a@other.example", "Subject: hi")
+	assertLines(out, t, `No rules matched; the message would be rejected`)
+	assert.False(strings.Contains(out, "Selected"), "no rule is selected:\n"+out, t)
+}
+
+func TestTestRulesSplit(t *testing.T) {
+	splitRecipients = true
+	defer func() { splitRecipients = false }()
+
+	var out = runTestRules(t, mkTestRules(t), "From: me@example.com", "To: a@example.org, b@other.example", "Subject: hi")
+	assertLines(out, t,
+		`Split delivery: rule 2 for a@example.org`,
+		`  + X-Tag: tagged`,
+		`  To: a@example.org`,
+		`  127.0.0.1:2`,
+		`No rules matched b@other.example; they would be rejected`,
+	)
+}
+
+func TestDiffLines(t *testing.T) {
+	var a = []string{"From: a", "To: b", "Subject: c"}
+	var b = []string{"From: a", "Subject: d"}
+	assert.Equal("To: b,Subject: c", strings.Join(diffLines(a, b), ","), "lines only in a", t)
+	assert.Equal("Subject: d", strings.Join(diffLines(b, a), ","), "lines only in b", t)
+	assert.Equal(0, len(diffLines(a, a)), "no differences", t)
+}
+
+func TestFormatCaptures(t *testing.T) {
+	var caps = rule.Captures{"10": "j", "2": "b", "user": "jo", "1": "a", "dept": "sales"}
+	assert.Equal(`1="a" 2="b" 10="j" dept="sales" user="jo"`, formatCaptures(caps), "numbered, then named", t)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Nerdmaster/sendmail/email"
+	"github.com/Nerdmaster/sendmail/smtpd"
+)
+
+// Limits for messages accepted over SMTP
+const (
+	maxMessageSize = 50 << 20
+	commandTimeout = 5 * time.Minute
+)
+
+// newSMTPServer returns an smtpd.Server which sends each accepted message
+// through the same rule matching and delivery as messages read from stdin
+func newSMTPServer(rules []*RuleConf) *smtpd.Server {
+	var hostname, err = os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+
+	return &smtpd.Server{
+		Hostname: hostname,
+		MaxSize:  maxMessageSize,
+		Timeout:  commandTimeout,
+		Handler: func(from string, to []string, data []byte) error {
+			return handleSMTP(rules, from, to, data)
+		},
+	}
+}
+
+// handleSMTP parses a message received over SMTP and delivers it, converting
+// failures to SMTP replies
+func handleSMTP(rules []*RuleConf, from string, to []string, data []byte) error {
+	var e, err = email.ReadIgnoringDots(bytes.NewReader(data))
+	if err != nil {
+		return &smtpd.Error{Code: 554, Message: "Unable to parse message: " + err.Error()}
+	}
+	e.Envelope.From = from
+	e.Envelope.To = to
+	e.Envelope.NullSender = from == ""
+
+	err = deliver(rules, e)
+	if err == nil {
+		log.Printf("Accepted message from %q to %q", from, to)
+		return nil
+	}
+
+	log.Printf("Unable to send email (from %q, to %q): %s", from, to, err)
+	if errors.Is(err, errNoMatch) {
+		return &smtpd.Error{Code: 550, Message: "No rules matched this message"}
+	}
+	var rej *rejectError
+	if errors.As(err, &rej) {
+		return &smtpd.Error{Code: 550, Message: rej.reason}
+	}
+	if email.IsTemporary(err) {
+		return &smtpd.Error{Code: 451, Message: "Temporary failure: " + err.Error()}
+	}
+	return &smtpd.Error{Code: 554, Message: "Delivery failed: " + err.Error()}
+}
+
+// serveStdio runs a single SMTP session on stdin and stdout, as inetd-style
+// sendmail does with "-bs"
+func serveStdio(rules []*RuleConf) {
+	newSMTPServer(rules).ServeConn(os.Stdin, os.Stdout)
+}
+
+// listen opens the listener for the given address: "unix:/path/to/socket" for
+// a Unix socket, otherwise a TCP host:port.  A stale Unix socket file is
+// removed first.
+func listen(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		var path = strings.TrimPrefix(addr, "unix:")
+		var info, err = os.Stat(path)
+		if err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// serveDaemon listens for SMTP connections until it gets SIGINT or SIGTERM.
+// If -q was given with an interval, the queue is run in the background, as
+// sendmail does with "-bd -q30m".
+func serveDaemon(rules []*RuleConf) {
+	// -q is checked before listening, since the queue runs in the background
+	var interval time.Duration
+	var err error
+	if opts.QueueRun != "" {
+		interval, err = queueInterval()
+		if err != nil {
+			log.Fatalf("Unable to run queue: %s", err)
+		}
+	}
+
+	var l net.Listener
+	l, err = listen(opts.Listen)
+	if err != nil {
+		log.Fatalf("Unable to listen on %q: %s", opts.Listen, err)
+	}
+
+	var sigs = make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		var sig = <-sigs
+		log.Printf("Got %s; shutting down", sig)
+		l.Close()
+	}()
+
+	switch {
+	case interval > 0:
+		go queueLoop(rules, interval)
+	case opts.QueueRun != "":
+		go queuePass(rules)
+	}
+
+	log.Printf("Listening for SMTP connections on %s", opts.Listen)
+	var s = newSMTPServer(rules)
+	err = s.Serve(l)
+	if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
+		log.Fatalf("Unable to accept connections: %s", err)
+	}
+}
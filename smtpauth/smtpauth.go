@@ -0,0 +1,229 @@
+// Package smtpauth provides smtp.Auth implementations for the mechanisms
+// net/smtp doesn't cover (LOGIN, XOAUTH2), a PLAIN implementation which can be
+// told to allow unencrypted connections, and automatic selection of a
+// mechanism from the list a server advertises.
+package smtpauth
+
+import (
+	"errors"
+	"fmt"
+	"net/smtp"
+	"strings"
+)
+
+// Credentials holds everything the various mechanisms might need
+type Credentials struct {
+	// Host is the server name credentials may be sent to.  If it's set and
+	// doesn't match the server's name, authentication is refused.
+	Host     string
+	Username string
+	Password string
+
+	// Token returns an OAuth2 access token for XOAUTH2.  It's called each time
+	// authentication starts, so it can fetch a fresh token when necessary.
+	Token func() (string, error)
+
+	// AllowInsecure permits sending credentials in the clear over connections
+	// which aren't encrypted and aren't to localhost
+	AllowInsecure bool
+}
+
+// New returns the smtp.Auth for the named mechanism: "plain", "login",
+// "cram-md5", "xoauth2", or "none".  "none" returns a nil smtp.Auth.  An empty
+// mechanism returns an Auto if there are any credentials, otherwise nil.
+func New(mechanism string, c Credentials) (smtp.Auth, error) {
+	switch strings.ToLower(mechanism) {
+	case "":
+		if c.Username == "" && c.Token == nil {
+			return nil, nil
+		}
+		return Auto(c), nil
+	case "none":
+		return nil, nil
+	case "plain":
+		return Plain(c), nil
+	case "login":
+		return Login(c), nil
+	case "cram-md5":
+		return smtp.CRAMMD5Auth(c.Username, c.Password), nil
+	case "xoauth2":
+		if c.Token == nil {
+			return nil, errors.New("xoauth2 requires a token")
+		}
+		return XOAUTH2(c), nil
+	}
+	return nil, fmt.Errorf("unknown auth mechanism %q", mechanism)
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
+
+// check returns an error if credentials shouldn't be sent to the server
+func (c Credentials) check(server *smtp.ServerInfo) error {
+	var err = c.checkHost(server)
+	if err == nil {
+		err = c.checkEncryption(server)
+	}
+	return err
+}
+
+// checkHost returns an error if the server isn't the one the credentials are
+// for
+func (c Credentials) checkHost(server *smtp.ServerInfo) error {
+	if c.Host != "" && server.Name != c.Host {
+		return fmt.Errorf("wrong host name %q (expected %q)", server.Name, c.Host)
+	}
+	return nil
+}
+
+// checkEncryption returns an error if a password can't be sent over the
+// connection
+func (c Credentials) checkEncryption(server *smtp.ServerInfo) error {
+	if !server.TLS && !c.AllowInsecure && !isLocalhost(server.Name) {
+		return errors.New("unencrypted connection")
+	}
+	return nil
+}
+
+type plainAuth struct {
+	Credentials
+}
+
+// Plain returns an smtp.Auth for the PLAIN mechanism.  Unlike smtp.PlainAuth,
+// it will send credentials over an unencrypted connection if c.AllowInsecure
+// is true.
+func Plain(c Credentials) smtp.Auth {
+	return &plainAuth{c}
+}
+
+func (a *plainAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	var err = a.check(server)
+	if err != nil {
+		return "", nil, err
+	}
+	return "PLAIN", []byte("\x00" + a.Username + "\x00" + a.Password), nil
+}
+
+func (a *plainAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		return nil, errors.New("unexpected server challenge")
+	}
+	return nil, nil
+}
+
+type loginAuth struct {
+	Credentials
+}
+
+// Login returns an smtp.Auth for the non-standard (but still common) LOGIN
+// mechanism
+func Login(c Credentials) smtp.Auth {
+	return &loginAuth{c}
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	var err = a.check(server)
+	if err != nil {
+		return "", nil, err
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	var prompt = strings.ToLower(string(fromServer))
+	switch {
+	case strings.Contains(prompt, "username"):
+		return []byte(a.Username), nil
+	case strings.Contains(prompt, "password"):
+		return []byte(a.Password), nil
+	}
+	return nil, fmt.Errorf("unexpected LOGIN challenge %q", fromServer)
+}
+
+type xoauth2Auth struct {
+	Credentials
+}
+
+// XOAUTH2 returns an smtp.Auth for Google's and Microsoft's XOAUTH2 mechanism.
+// c.Token must not be nil.
+func XOAUTH2(c Credentials) smtp.Auth {
+	return &xoauth2Auth{c}
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	var err = a.check(server)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var token string
+	token, err = a.Token()
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to get xoauth2 token: %w", err)
+	}
+	return "XOAUTH2", []byte("user=" + a.Username + "\x01auth=Bearer " + token + "\x01\x01"), nil
+}
+
+// Next handles the server's error challenge: XOAUTH2 servers send JSON
+// describing the failure and expect an empty response before they send the
+// final error
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+type autoAuth struct {
+	Credentials
+	chosen smtp.Auth
+}
+
+// Auto returns an smtp.Auth which picks a mechanism from those the server
+// advertises.  On encrypted (or explicitly insecure) connections the order of
+// preference is XOAUTH2 (only if c.Token is set), PLAIN, LOGIN, then
+// CRAM-MD5.  Otherwise only CRAM-MD5 is considered, as it doesn't send the
+// password itself.  A server whose name doesn't match c.Host is refused
+// whatever it offers.
+func Auto(c Credentials) smtp.Auth {
+	return &autoAuth{Credentials: c}
+}
+
+func (a *autoAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	var offered = make(map[string]bool)
+	for _, m := range server.Auth {
+		offered[strings.ToUpper(m)] = true
+	}
+
+	var err = a.checkHost(server)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var secure = a.checkEncryption(server) == nil
+	a.chosen = nil
+	switch {
+	case secure && a.Token != nil && offered["XOAUTH2"]:
+		a.chosen = XOAUTH2(a.Credentials)
+	case secure && a.Username != "" && offered["PLAIN"]:
+		a.chosen = Plain(a.Credentials)
+	case secure && a.Username != "" && offered["LOGIN"]:
+		a.chosen = Login(a.Credentials)
+	case a.Username != "" && offered["CRAM-MD5"]:
+		a.chosen = smtp.CRAMMD5Auth(a.Username, a.Password)
+	}
+
+	if a.chosen == nil {
+		return "", nil, fmt.Errorf("no usable auth mechanism among %q", server.Auth)
+	}
+	return a.chosen.Start(server)
+}
+
+func (a *autoAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	return a.chosen.Next(fromServer, more)
+}
@@ -0,0 +1,105 @@
+package smtpauth
+
+import (
+	"errors"
+	"net/smtp"
+	"testing"
+
+	"github.com/uoregon-libraries/gopkg/assert"
+)
+
+var creds = Credentials{Host: "mail.example.org", Username: "me", Password: "secret"}
+
+func TestPlain(t *testing.T) {
+	var a = Plain(creds)
+	var proto, resp, err = a.Start(&smtp.ServerInfo{Name: "mail.example.org", TLS: true})
+	assert.NilError(err, "starting PLAIN over TLS", t)
+	assert.Equal("PLAIN", proto, "mechanism", t)
+	assert.Equal("\x00me\x00secret", string(resp), "initial response", t)
+
+	_, _, err = a.Start(&smtp.ServerInfo{Name: "mail.example.org"})
+	assert.True(err != nil, "PLAIN refuses unencrypted connections", t)
+	_, _, err = a.Start(&smtp.ServerInfo{Name: "other.example.org", TLS: true})
+	assert.True(err != nil, "PLAIN refuses the wrong host", t)
+
+	var insecure = creds
+	insecure.AllowInsecure = true
+	_, _, err = Plain(insecure).Start(&smtp.ServerInfo{Name: "mail.example.org"})
+	assert.NilError(err, "PLAIN allows unencrypted connections when told to", t)
+}
+
+func TestLogin(t *testing.T) {
+	var a = Login(creds)
+	var proto, resp, err = a.Start(&smtp.ServerInfo{Name: "mail.example.org", TLS: true})
+	assert.NilError(err, "starting LOGIN", t)
+	assert.Equal("LOGIN", proto, "mechanism", t)
+	assert.Equal(0, len(resp), "no initial response", t)
+
+	resp, err = a.Next([]byte("Username:"), true)
+	assert.NilError(err, "username challenge", t)
+	assert.Equal("me", string(resp), "username response", t)
+	resp, err = a.Next([]byte("Password:"), true)
+	assert.NilError(err, "password challenge", t)
+	assert.Equal("secret", string(resp), "password response", t)
+	_, err = a.Next([]byte("Favorite color:"), true)
+	assert.True(err != nil, "unknown challenges are errors", t)
+}
+
+func TestXOAUTH2(t *testing.T) {
+	var c = creds
+	c.Token = func() (string, error) { return "tok", nil }
+	var proto, resp, err = XOAUTH2(c).Start(&smtp.ServerInfo{Name: "mail.example.org", TLS: true})
+	assert.NilError(err, "starting XOAUTH2", t)
+	assert.Equal("XOAUTH2", proto, "mechanism", t)
+	assert.Equal("user=me\x01auth=Bearer tok\x01\x01", string(resp), "initial response", t)
+
+	c.Token = func() (string, error) { return "", errors.New("no token") }
+	_, _, err = XOAUTH2(c).Start(&smtp.ServerInfo{Name: "mail.example.org", TLS: true})
+	assert.True(err != nil, "token errors stop authentication", t)
+}
+
+func TestAuto(t *testing.T) {
+	var tests = []struct {
+		tls      bool
+		offered  []string
+		expected string
+	}{
+		{true, []string{"LOGIN", "PLAIN", "CRAM-MD5"}, "PLAIN"},
+		{true, []string{"LOGIN", "CRAM-MD5"}, "LOGIN"},
+		{true, []string{"XOAUTH2", "CRAM-MD5"}, "CRAM-MD5"},
+		{false, []string{"LOGIN", "PLAIN", "CRAM-MD5"}, "CRAM-MD5"},
+		{false, []string{"LOGIN", "PLAIN"}, ""},
+	}
+
+	for _, test := range tests {
+		var a = Auto(creds)
+		var proto, _, err = a.Start(&smtp.ServerInfo{Name: "mail.example.org", TLS: test.tls, Auth: test.offered})
+		if test.expected == "" {
+			assert.True(err != nil, "no usable mechanism", t)
+			continue
+		}
+		assert.NilError(err, "starting auto auth", t)
+		assert.Equal(test.expected, proto, "chosen mechanism", t)
+	}
+
+	// A host mismatch is refused rather than falling back to CRAM-MD5
+	var _, _, err = Auto(creds).Start(&smtp.ServerInfo{Name: "evil.example.org", TLS: false, Auth: []string{"PLAIN", "CRAM-MD5"}})
+	assert.True(err != nil, "wrong host is refused", t)
+	_, _, err = Auto(creds).Start(&smtp.ServerInfo{Name: "evil.example.org", TLS: true, Auth: []string{"PLAIN"}})
+	assert.True(err != nil, "wrong host is refused over TLS", t)
+}
+
+func TestNew(t *testing.T) {
+	var a, err = New("none", creds)
+	assert.NilError(err, "none", t)
+	assert.True(a == nil, "none returns no auth", t)
+
+	a, err = New("", Credentials{})
+	assert.NilError(err, "empty mechanism without credentials", t)
+	assert.True(a == nil, "empty mechanism without credentials returns no auth", t)
+
+	_, err = New("xoauth2", creds)
+	assert.True(err != nil, "xoauth2 without a token is an error", t)
+	_, err = New("kerberos", creds)
+	assert.True(err != nil, "unknown mechanisms are errors", t)
+}
@@ -0,0 +1,253 @@
+// Package smtpd is a minimal SMTP server: just enough of RFC 5321 to accept
+// messages from local programs and hand them off to a Handler.  It doesn't
+// relay, authenticate, or encrypt anything, so it should only listen on
+// localhost or a Unix socket.
+package smtpd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Handler is called for each message the server accepts.  A nil return
+// results in a success reply.  An *Error is sent to the client as-is, and any
+// other error is reported as a temporary failure.
+type Handler func(from string, to []string, data []byte) error
+
+// Error is an SMTP reply code and message for a Handler to return
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s", e.Code, e.Message)
+}
+
+// Server holds the settings for accepting SMTP sessions
+type Server struct {
+	// Hostname is used in the greeting and EHLO reply
+	Hostname string
+
+	// Handler processes each accepted message
+	Handler Handler
+
+	// MaxSize is the largest message, in bytes, which will be accepted.  Zero
+	// means there's no limit.
+	MaxSize int64
+
+	// Timeout is how long the server waits for each command from a network
+	// client before hanging up.  Zero means there's no limit.
+	Timeout time.Duration
+}
+
+// Serve accepts connections on l, handling each in its own goroutine, until
+// l returns an error
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		var conn, err = l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			s.ServeConn(conn, conn)
+		}()
+	}
+}
+
+// session holds the state of a single SMTP conversation
+type session struct {
+	s    *Server
+	r    *textproto.Reader
+	w    *textproto.Writer
+	conn net.Conn
+	from string
+	to   []string
+	mail bool
+}
+
+// ServeConn runs a single SMTP session, reading commands from r and writing
+// replies to w.  It returns when the client quits or the connection fails.
+// This is how sendmail's "-bs" mode works, with r and w being stdin and
+// stdout.
+func (s *Server) ServeConn(r io.Reader, w io.Writer) {
+	var sess = &session{
+		s: s,
+		r: textproto.NewReader(bufio.NewReader(r)),
+		w: textproto.NewWriter(bufio.NewWriter(w)),
+	}
+	sess.conn, _ = r.(net.Conn)
+	sess.run()
+}
+
+func (sess *session) reply(code int, format string, args ...interface{}) error {
+	return sess.w.PrintfLine("%d %s", code, fmt.Sprintf(format, args...))
+}
+
+func (sess *session) reset() {
+	sess.from = ""
+	sess.to = nil
+	sess.mail = false
+}
+
+func (sess *session) readLine() (string, error) {
+	if sess.conn != nil && sess.s.Timeout > 0 {
+		sess.conn.SetReadDeadline(time.Now().Add(sess.s.Timeout))
+	}
+	return sess.r.ReadLine()
+}
+
+func (sess *session) run() {
+	var err = sess.reply(220, "%s ESMTP go-sendmail", sess.s.Hostname)
+	for err == nil {
+		var line string
+		line, err = sess.readLine()
+		if err != nil {
+			return
+		}
+
+		var parts = strings.SplitN(line, " ", 2)
+		var cmd, arg = strings.ToUpper(parts[0]), ""
+		if len(parts) == 2 {
+			arg = strings.TrimSpace(parts[1])
+		}
+
+		switch cmd {
+		case "HELO":
+			sess.reset()
+			err = sess.reply(250, "%s", sess.s.Hostname)
+		case "EHLO":
+			sess.reset()
+			err = sess.ehlo()
+		case "MAIL":
+			err = sess.mailFrom(arg)
+		case "RCPT":
+			err = sess.rcptTo(arg)
+		case "DATA":
+			err = sess.data()
+		case "RSET":
+			sess.reset()
+			err = sess.reply(250, "OK")
+		case "NOOP":
+			err = sess.reply(250, "OK")
+		case "VRFY":
+			err = sess.reply(252, "Cannot verify user")
+		case "HELP":
+			err = sess.reply(214, "See RFC 5321")
+		case "QUIT":
+			sess.reply(221, "Bye")
+			return
+		default:
+			err = sess.reply(502, "Command not implemented")
+		}
+	}
+}
+
+func (sess *session) ehlo() error {
+	var lines = []string{sess.s.Hostname, "8BITMIME", "PIPELINING"}
+	if sess.s.MaxSize > 0 {
+		lines = append(lines, fmt.Sprintf("SIZE %d", sess.s.MaxSize))
+	}
+	for i, l := range lines {
+		var sep = "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		var err = sess.w.PrintfLine("250%s%s", sep, l)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parsePath pulls the address out of a MAIL or RCPT argument, which looks like
+// "FROM:<addr> [params]" or "TO:<addr> [params]"
+func parsePath(arg, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(arg, "<") {
+		return "", false
+	}
+	var end = strings.Index(arg, ">")
+	if end < 0 {
+		return "", false
+	}
+	return arg[1:end], true
+}
+
+func (sess *session) mailFrom(arg string) error {
+	if sess.mail {
+		return sess.reply(503, "Sender already specified")
+	}
+	var addr, ok = parsePath(arg, "FROM:")
+	if !ok {
+		return sess.reply(501, "Syntax: MAIL FROM:<address>")
+	}
+	sess.from = addr
+	sess.mail = true
+	return sess.reply(250, "OK")
+}
+
+func (sess *session) rcptTo(arg string) error {
+	if !sess.mail {
+		return sess.reply(503, "Need MAIL before RCPT")
+	}
+	var addr, ok = parsePath(arg, "TO:")
+	if !ok || addr == "" {
+		return sess.reply(501, "Syntax: RCPT TO:<address>")
+	}
+	sess.to = append(sess.to, addr)
+	return sess.reply(250, "OK")
+}
+
+func (sess *session) data() error {
+	if len(sess.to) == 0 {
+		return sess.reply(503, "Need RCPT before DATA")
+	}
+	var err = sess.reply(354, "End data with <CR><LF>.<CR><LF>")
+	if err != nil {
+		return err
+	}
+
+	var dr = sess.r.DotReader()
+	var r = dr
+	if sess.s.MaxSize > 0 {
+		r = io.LimitReader(dr, sess.s.MaxSize+1)
+	}
+	var msg []byte
+	msg, err = ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if sess.s.MaxSize > 0 && int64(len(msg)) > sess.s.MaxSize {
+		// Drain the rest of the message so the session stays in sync
+		io.Copy(ioutil.Discard, dr)
+		sess.reset()
+		return sess.reply(552, "Message exceeds maximum size")
+	}
+
+	var from, to = sess.from, sess.to
+	sess.reset()
+	err = sess.s.Handler(from, to, msg)
+	if err == nil {
+		return sess.reply(250, "OK: message accepted")
+	}
+
+	var smtpErr, ok = err.(*Error)
+	if ok {
+		return sess.reply(smtpErr.Code, "%s", smtpErr.Message)
+	}
+	log.Printf("smtpd: unable to handle message from %q: %s", from, err)
+	return sess.reply(451, "Temporary failure processing message")
+}
@@ -0,0 +1,84 @@
+package smtpd
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/uoregon-libraries/gopkg/assert"
+)
+
+type received struct {
+	from string
+	to   []string
+	data string
+}
+
+func runSession(t *testing.T, s *Server, lines ...string) []string {
+	var in = strings.NewReader(strings.Join(lines, "\r\n") + "\r\n")
+	var out bytes.Buffer
+	s.ServeConn(in, &out)
+	return strings.Split(strings.TrimSpace(out.String()), "\r\n")
+}
+
+func TestSession(t *testing.T) {
+	var got []received
+	var s = &Server{Hostname: "test.example.org", Handler: func(from string, to []string, data []byte) error {
+		got = append(got, received{from, to, string(data)})
+		return nil
+	}}
+
+	var replies = runSession(t, s,
+		"EHLO client",
+		"RCPT TO:<nope@example.org>",
+		"MAIL FROM:<me@example.org> BODY=8BITMIME",
+		"RCPT TO:<you@example.org>",
+		"rcpt to: <her@example.org>",
+		"DATA",
+		"Subject: hi",
+		"",
+		"..leading dot",
+		".",
+		"QUIT",
+	)
+
+	assert.Equal("220 test.example.org ESMTP go-sendmail", replies[0], "greeting", t)
+	assert.Equal("250-test.example.org", replies[1], "ehlo", t)
+	assert.True(strings.HasPrefix(replies[4], "503 "), "RCPT before MAIL is rejected", t)
+	assert.True(strings.HasPrefix(replies[9], "250 "), "message accepted", t)
+	assert.Equal("221 Bye", replies[10], "quit", t)
+
+	assert.Equal(1, len(got), "one message", t)
+	assert.Equal("me@example.org", got[0].from, "envelope from", t)
+	assert.Equal("you@example.org,her@example.org", strings.Join(got[0].to, ","), "envelope to", t)
+	assert.Equal("Subject: hi\n\n.leading dot\n", got[0].data, "data is dot-unstuffed", t)
+}
+
+func TestHandlerErrors(t *testing.T) {
+	var errs = []error{&Error{Code: 550, Message: "No thanks"}, errors.New("disk full")}
+	var s = &Server{Hostname: "test", Handler: func(string, []string, []byte) error {
+		var err = errs[0]
+		errs = errs[1:]
+		return err
+	}}
+
+	var msg = []string{"MAIL FROM:<>", "RCPT TO:<you@example.org>", "DATA", "hi", "."}
+	var replies = runSession(t, s, append(append(append([]string{"HELO client"}, msg...), msg...), "QUIT")...)
+	assert.Equal("550 No thanks", replies[5], "handler's SMTP error", t)
+	assert.True(strings.HasPrefix(replies[9], "451 "), "other errors are temporary", t)
+}
+
+func TestMaxSize(t *testing.T) {
+	var called bool
+	var s = &Server{Hostname: "test", MaxSize: 10, Handler: func(string, []string, []byte) error {
+		called = true
+		return nil
+	}}
+
+	var replies = runSession(t, s, "HELO client", "MAIL FROM:<me@example.org>", "RCPT TO:<you@example.org>",
+		"DATA", "this line is far too long", "and so is this one", ".", "NOOP", "QUIT")
+	assert.True(strings.HasPrefix(replies[5], "552 "), "oversized message is rejected", t)
+	assert.Equal("250 OK", replies[6], "session continues after the oversized message", t)
+	assert.False(called, "handler isn't called", t)
+}
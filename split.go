@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/Nerdmaster/sendmail/email"
+)
+
+// recipientGroup holds the recipients of a message which matched the same
+// rules
+type recipientGroup struct {
+	chain []ruleMatch
+	rcpts []string
+}
+
+// forRecipient returns a copy of the email's header and envelope as if the
+// message were addressed only to rcpt: the envelope and To hold just that
+// recipient, and there's no Cc or Bcc.  The message data (and its parsed MIME
+// parts) are shared, so the copy mustn't be modified.
+func forRecipient(e *email.Email, rcpt string) *email.Email {
+	var e2 = *e
+	e2.Header = e.Header.Clone()
+	e2.Envelope.To = []string{rcpt}
+	e2.Header.Set("to", rcpt)
+	e2.Header.Del("cc")
+	e2.Header.Del("bcc")
+	return &e2
+}
+
+// groupRecipients partitions the email's recipients by the rules each one
+// matches when the message is addressed only to them.  Recipients which
+// no rule matches are returned separately.  A recipient listed more than once
+// (e.g., in both To and Cc) is only grouped once.
+func groupRecipients(rules []*RuleConf, e *email.Email) (groups []*recipientGroup, unmatched []string, err error) {
+	var list []string
+	list, err = e.Recipients()
+	if err != nil {
+		return nil, nil, err
+	}
+	var rcpts []string
+	for _, rcpt := range list {
+		rcpts = email.AppendAddress(rcpts, rcpt)
+	}
+
+	var byChain = make(map[string]*recipientGroup)
+	for _, rcpt := range rcpts {
+		var chain = matchRules(rules, forRecipient(e, rcpt))
+		if chain == nil {
+			unmatched = append(unmatched, rcpt)
+			continue
+		}
+		var key = fmt.Sprint(chain)
+		if byChain[key] == nil {
+			byChain[key] = &recipientGroup{chain: chain}
+			groups = append(groups, byChain[key])
+		}
+		byChain[key].rcpts = append(byChain[key].rcpts, rcpt)
+	}
+
+	return groups, unmatched, nil
+}
+
+// partialError is returned by deliverSplit when some recipients got the
+// message and others didn't.  It's never temporary: retrying the whole
+// message would send a duplicate to the recipients who already have it.
+type partialError struct {
+	delivered []string
+	failures  []string
+}
+
+func (e *partialError) Error() string {
+	return fmt.Sprintf("delivered to %s, but not to %s",
+		strings.Join(e.delivered, ", "), strings.Join(e.failures, "; "))
+}
+
+// deliverSplit delivers the email separately to each group of recipients
+// which match the same rule.  Each group gets its own copy of the message, so
+// one rule's actions don't affect what another group receives.  The header is
+// otherwise left alone: every copy still shows all the To and Cc addresses.
+//
+// If some groups got the message (or had it queued) and others failed, a
+// partialError lists the failed recipients.  Otherwise the error is a
+// rejection if every group was rejected or unmatched, and temporary only if
+// every failure was.
+func deliverSplit(rules []*RuleConf, e *email.Email) error {
+	var groups, unmatched, err = groupRecipients(rules, e)
+	if err != nil {
+		return err
+	}
+	if len(groups) == 0 {
+		return errNoMatch
+	}
+
+	var failures, delivered []string
+	var rejections, temporary int
+	for _, g := range groups {
+		if opts.Verbose {
+			log.Printf("DEBUG: Delivering to %q via rule %d", g.rcpts, g.chain[len(g.chain)-1].index)
+		}
+		var part = e.Clone()
+		part.Envelope.To = g.rcpts
+		err = process(rules, g.chain, part)
+		if err == nil {
+			delivered = append(delivered, g.rcpts...)
+			continue
+		}
+
+		var rej *rejectError
+		switch {
+		case errors.As(err, &rej):
+			rejections++
+		case email.IsTemporary(err):
+			temporary++
+		}
+		failures = append(failures, fmt.Sprintf("%s: %s", strings.Join(g.rcpts, ", "), err))
+	}
+	if len(unmatched) > 0 {
+		rejections++
+		failures = append(failures, fmt.Sprintf("%s: %s", strings.Join(unmatched, ", "), errNoMatch))
+	}
+
+	switch {
+	case len(failures) == 0:
+		return nil
+	case len(delivered) > 0:
+		return &partialError{delivered: delivered, failures: failures}
+	case rejections == len(failures):
+		return &rejectError{reason: strings.Join(failures, "; ")}
+	case temporary == len(failures):
+		return email.Temporary(errors.New(strings.Join(failures, "; ")))
+	}
+	return errors.New(strings.Join(failures, "; "))
+}
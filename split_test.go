@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/Nerdmaster/sendmail/email"
+	"github.com/Nerdmaster/sendmail/smtpd"
+	"github.com/uoregon-libraries/gopkg/assert"
+)
+
+// mkSplitRules returns rules which reject mail to rejected.example, discard
+// mail to discard.example, and send mail to example.org and bad.example
+// through fs.  Mail to drop.example has every recipient dropped before it's
+// sent through fs, and mail to tmpl.example is redirected by a template
+// which can't render.  Nothing else matches.
+func mkSplitRules(t *testing.T, fs *fakeServer) []*RuleConf {
+	var auth = fmt.Sprintf("  auth: {server: %q, mechanism: none, tls: none}\n", fs.addr)
+	var data = "" +
+		"- matchers: [\"To/domain:rejected.example\"]\n  actions: ['Reject \"no thanks\"']\n" +
+		"- matchers: [\"To/domain:discard.example\"]\n  actions: ['Discard']\n" +
+		"- matchers: [\"To/domain:example.org\"]\n" + auth +
+		"- matchers: [\"To/domain:bad.example\"]\n" + auth +
+		"- matchers: [\"To/domain:drop.example\"]\n  actions: ['DropRecipient *']\n" + auth +
+		"- matchers: [\"To/domain:tmpl.example\"]\n  actions: ['Redirect {{.Captures.user}}@example.org']\n" + auth
+	return mkrules(t, data)
+}
+
+func TestGroupRecipients(t *testing.T) {
+	var rules = mkSplitRules(t, &fakeServer{addr: "127.0.0.1:1"})
+	var e = mkemail(t, "a@example.org, b@discard.example, c@example.org\nCc: d@nowhere.test")
+
+	var groups, unmatched, err = groupRecipients(rules, e)
+	assert.NilError(err, "grouping recipients", t)
+	assert.Equal(2, len(groups), "number of groups", t)
+	assert.Equal("a@example.org,c@example.org", strings.Join(groups[0].rcpts, ","), "first group", t)
+	assert.Equal(2, groups[0].chain[0].index, "first group's rule", t)
+	assert.Equal("b@discard.example", strings.Join(groups[1].rcpts, ","), "second group", t)
+	assert.Equal(1, groups[1].chain[0].index, "second group's rule", t)
+	assert.Equal("d@nowhere.test", strings.Join(unmatched, ","), "unmatched recipients", t)
+}
+
+func TestGroupRecipientsDedupes(t *testing.T) {
+	var rules = mkSplitRules(t, &fakeServer{addr: "127.0.0.1:1"})
+	var e = mkemail(t, "a@example.org, z@nowhere.test\nCc: A@Example.org, Z@nowhere.test")
+
+	var groups, unmatched, err = groupRecipients(rules, e)
+	assert.NilError(err, "grouping recipients", t)
+	assert.Equal(1, len(groups), "number of groups", t)
+	assert.Equal("a@example.org", strings.Join(groups[0].rcpts, ","), "duplicate recipient is grouped once", t)
+	assert.Equal("z@nowhere.test", strings.Join(unmatched, ","), "duplicate unmatched recipient is listed once", t)
+
+	var fs = newFakeServer(t)
+	rules = mkSplitRules(t, fs)
+	err = deliverSplit(rules, mkemail(t, "a@example.org, x@bad.example\nCc: A@example.org, X@bad.example"))
+	assert.True(err != nil, "partial delivery is an error", t)
+	assert.Equal(1, strings.Count(strings.ToLower(err.Error()), "x@bad.example"), "failed recipient is reported once: "+err.Error(), t)
+	assert.Equal("a@example.org", fs.recipients(), "recipient is delivered to once", t)
+}
+
+func TestDeliverSplit(t *testing.T) {
+	var fs = newFakeServer(t)
+	var rules = mkSplitRules(t, fs)
+
+	var err = deliverSplit(rules, mkemail(t, "a@example.org, x@bad.example, y@rejected.example, z@nowhere.test"))
+	var partial *partialError
+	assert.True(errors.As(err, &partial), "partial delivery is an error", t)
+	assert.Equal("a@example.org", strings.Join(partial.delivered, ","), "delivered recipients in the error", t)
+	assert.Equal(3, len(partial.failures), "failed groups: "+err.Error(), t)
+	for _, rcpt := range []string{"x@bad.example", "y@rejected.example", "z@nowhere.test"} {
+		assert.True(strings.Contains(err.Error(), rcpt), "failed recipient "+rcpt+" is reported", t)
+	}
+	assert.False(email.IsTemporary(err), "partial delivery can't be retried", t)
+	assert.Equal("a@example.org", fs.recipients(), "delivered recipients", t)
+
+	splitRecipients = true
+	defer func() { splitRecipients = false }()
+	var serr = handleSMTP(rules, "me@example.com", []string{"b@example.org", "x@bad.example"}, []byte("Subject: hi\r\n\r\nhi\r\n"))
+	var reply *smtpd.Error
+	assert.True(errors.As(serr, &reply), "partial delivery over SMTP is an error reply", t)
+	assert.Equal(554, reply.Code, "partial delivery is a permanent failure", t)
+	assert.True(strings.Contains(reply.Message, "x@bad.example"), "reply names the failed recipient: "+reply.Message, t)
+	assert.Equal("a@example.org,b@example.org", fs.recipients(), "delivered recipients", t)
+
+	err = deliverSplit(rules, mkemail(t, "x@bad.example, y@rejected.example"))
+	var rej *rejectError
+	assert.True(err != nil, "nothing delivered is an error", t)
+	assert.False(errors.As(err, &rej), "a failure other than a rejection isn't a rejection", t)
+	assert.False(email.IsTemporary(err), "a permanent failure isn't temporary", t)
+
+	err = deliverSplit(rules, mkemail(t, "y@rejected.example, z@nowhere.test"))
+	assert.True(errors.As(err, &rej), "every group rejected or unmatched is a rejection", t)
+	assert.True(strings.Contains(rej.reason, "no thanks"), "rejection reason: "+rej.reason, t)
+
+	err = deliverSplit(rules, mkemail(t, "z@nowhere.test"))
+	assert.True(errors.Is(err, errNoMatch), "no rule matching any recipient", t)
+
+	err = deliverSplit(rules, mkemail(t, "b@discard.example"))
+	assert.NilError(err, "discarded group", t)
+	assert.Equal("a@example.org,b@example.org", fs.recipients(), "nothing more delivered", t)
+}
+
+func TestDropEveryRecipient(t *testing.T) {
+	var fs = newFakeServer(t)
+	var rules = mkSplitRules(t, fs)
+
+	var err = deliver(rules, mkemail(t, "x@drop.example\nCc: a@example.org"))
+	assert.NilError(err, "message with every recipient dropped is discarded", t)
+	assert.Equal("", fs.recipients(), "nobody gets a message whose recipients were all dropped", t)
+
+	err = deliverSplit(rules, mkemail(t, "x@drop.example, a@example.org"))
+	assert.NilError(err, "split delivery", t)
+	assert.Equal("a@example.org", fs.recipients(), "only the group which kept its recipients gets the message", t)
+}
+
+func TestRecipientTemplateFailure(t *testing.T) {
+	var fs = newFakeServer(t)
+	var rules = mkSplitRules(t, fs)
+
+	var err = deliver(rules, mkemail(t, "x@tmpl.example"))
+	assert.True(err != nil, "a recipient template which can't render is a delivery error", t)
+	assert.False(email.IsTemporary(err), "the error is permanent", t)
+	assert.Equal("", fs.recipients(), "nothing is sent to the original recipients", t)
+}
+
+func TestHandleSMTPNullSender(t *testing.T) {
+	var fs = newFakeServer(t)
+	var rules = mkSplitRules(t, fs)
+
+	var data = []byte("From: Mail Delivery System <mailer-daemon@example.com>\r\nTo: a@example.org\r\n" +
+		"Subject: Undeliverable\r\n\r\nSorry\r\n")
+	var err = handleSMTP(rules, "", []string{"a@example.org"}, data)
+	assert.NilError(err, "a message with the null sender is accepted", t)
+	assert.Equal("a@example.org", fs.recipients(), "delivered recipients", t)
+	fs.mu.Lock()
+	assert.Equal("<>", strings.Join(fs.senders, ","), "null sender is passed on", t)
+	fs.mu.Unlock()
+}
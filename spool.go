@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/Nerdmaster/sendmail/email"
+	"github.com/Nerdmaster/sendmail/queue"
+	flags "github.com/jessevdk/go-flags"
+)
+
+// enqueue spools the email for a later retry after a temporary failure
+// sending it via the matched rule, or because the rule deferred it
+func enqueue(rules []*RuleConf, m ruleMatch, e *email.Email, sendErr error) error {
+	var q, err = queue.Open(opts.QueueDir)
+	if err != nil {
+		return fmt.Errorf("%w (unable to open queue: %s)", sendErr, err)
+	}
+
+	var en *queue.Entry
+	en, err = q.Add(e, rules[m.index].id(), m.captures, sendErr)
+	if err != nil {
+		return fmt.Errorf("%w (unable to queue message: %s)", sendErr, err)
+	}
+
+	if sendErr == errDeferred {
+		log.Printf("Deferred email; queued as %s", en.ID)
+	} else {
+		log.Printf("Temporary failure sending email (%s); queued as %s", sendErr, en.ID)
+	}
+	return nil
+}
+
+// queueInterval returns the interval given to -q, or zero for a single run
+func queueInterval() (time.Duration, error) {
+	if opts.QueueRun == "once" {
+		return 0, nil
+	}
+	var interval, err = time.ParseDuration(opts.QueueRun)
+	if err != nil || interval <= 0 {
+		return 0, fmt.Errorf("invalid queue interval %q", opts.QueueRun)
+	}
+	return interval, nil
+}
+
+// runQueue retries everything in the queue that's due, either once or, if an
+// interval was given to -q, forever
+func runQueue(rules []*RuleConf) {
+	var interval, err = queueInterval()
+	if err != nil {
+		log.Fatalf("Unable to run queue: %s", err)
+	}
+	if interval > 0 {
+		queueLoop(rules, interval)
+		return
+	}
+
+	var q = openQueue()
+	var unlock func()
+	unlock, err = q.Lock()
+	if err != nil {
+		log.Fatalf("Unable to run queue: %s", err)
+	}
+	defer unlock()
+	flushQueue(q, rules)
+}
+
+// queueLoop runs the queue every interval, forever.  The queue is only
+// locked during each pass, so queue commands can run while the loop sleeps.
+// Problems are logged and the pass is tried again next time, so the loop is
+// safe to run in the background of the SMTP daemon.
+func queueLoop(rules []*RuleConf, interval time.Duration) {
+	for {
+		queuePass(rules)
+		time.Sleep(interval)
+	}
+}
+
+// queuePass does one run of the queue for queueLoop
+func queuePass(rules []*RuleConf) {
+	var q, err = queue.Open(opts.QueueDir)
+	if err != nil {
+		log.Printf("Skipping queue run: unable to open queue %q: %s", opts.QueueDir, err)
+		return
+	}
+
+	var unlock func()
+	unlock, err = q.Lock()
+	if err != nil {
+		log.Printf("Skipping queue run: %s", err)
+		return
+	}
+	defer unlock()
+	flushQueue(q, rules)
+}
+
+// flushQueue retries all entries whose next attempt is due
+func flushQueue(q *queue.Queue, rules []*RuleConf) {
+	var list, err = q.Entries()
+	if err != nil {
+		log.Printf("Unable to read queue %q: %s", q.Dir, err)
+		return
+	}
+
+	var now = time.Now()
+	for _, en := range list {
+		if en.Held || now.Before(en.NextAttempt) {
+			continue
+		}
+		if opts.Dryrun {
+			log.Printf("Dry run requested; not retrying %s", en.ID)
+			continue
+		}
+		retry(q, rules, en)
+	}
+}
+
+// retry attempts delivery of a single queued entry.  The entry is removed on
+// success, on a permanent failure, or once it's older than the queue
+// lifetime; otherwise its next attempt is rescheduled.
+func retry(q *queue.Queue, rules []*RuleConf, en *queue.Entry) {
+	if opts.Verbose {
+		log.Printf("DEBUG: Retrying %s (attempt %d, rule %q)", en.ID, en.Attempts+1, en.RuleID)
+	}
+
+	// If the config no longer has the rule, the message is held rather than
+	// sent through some other rule's servers or thrown away
+	var r = findRule(rules, en)
+	if r == nil {
+		log.Printf("Holding queued message %s: rule %q no longer exists", en.ID, en.RuleID)
+		var err = q.Hold(en)
+		if err != nil {
+			log.Printf("Unable to hold queue entry %s: %s", en.ID, err)
+		}
+		return
+	}
+
+	var err = resend(q, r, en)
+	switch {
+	case err == nil:
+		log.Printf("Delivered queued message %s", en.ID)
+	case !email.IsTemporary(err):
+		log.Printf("Giving up on queued message %s (from %q, to %q): %s", en.ID, en.Sender, en.Recipients, err)
+	case time.Since(en.Created) > opts.QueueLifetime:
+		log.Printf("Giving up on queued message %s (from %q, to %q) after %s: %s",
+			en.ID, en.Sender, en.Recipients, opts.QueueLifetime, err)
+	default:
+		en.Failed(err)
+		log.Printf("Temporary failure retrying %s (%s); next attempt at %s", en.ID, err, en.NextAttempt.Format(time.RFC3339))
+		err = q.Update(en)
+		if err != nil {
+			log.Printf("Unable to update queue entry %s: %s", en.ID, err)
+		}
+		return
+	}
+
+	err = q.Remove(en)
+	if err != nil {
+		log.Printf("Unable to remove queue entry %s: %s", en.ID, err)
+	}
+}
+
+// findRule returns the rule the entry was queued by, or nil if there's no
+// longer such a rule
+func findRule(rules []*RuleConf, en *queue.Entry) *RuleConf {
+	for _, r := range rules {
+		if r.id() == en.RuleID {
+			return r
+		}
+	}
+	return nil
+}
+
+// resend reads the entry's message and sends it via the rule it originally
+// matched
+func resend(q *queue.Queue, r *RuleConf, en *queue.Entry) error {
+	var e, err = q.Message(en)
+	if err != nil {
+		return err
+	}
+	return r.send(e, en.Captures)
+}
+
+// queueIDArgs holds the positional argument for queue subcommands which act on
+// a single entry
+type queueIDArgs struct {
+	Args struct {
+		ID string `positional-arg-name:"id"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+type queueCommands struct {
+	List    struct{}    `command:"list" description:"List queued messages (same as -bp)"`
+	Flush   queueIDArgs `command:"flush" description:"Retry a queued message right away"`
+	Delete  queueIDArgs `command:"delete" description:"Remove a message from the queue without sending it"`
+	Hold    queueIDArgs `command:"hold" description:"Stop retrying a message until it's released"`
+	Release queueIDArgs `command:"release" description:"Release a held message so it's retried on the next queue run"`
+	Dump    queueIDArgs `command:"dump" description:"Write a queued message to stdout"`
+}
+
+// openQueue opens the queue directory, exiting if that fails
+func openQueue() *queue.Queue {
+	var q, err = queue.Open(opts.QueueDir)
+	if err != nil {
+		log.Fatalf("Unable to open queue %q: %s", opts.QueueDir, err)
+	}
+	return q
+}
+
+// runQueueCommand handles the "queue" command's subcommands
+func runQueueCommand(cmd *flags.Command) {
+	if cmd.Active.Name == "list" {
+		listQueue()
+		return
+	}
+
+	// Dumping a message only reads it, so it doesn't need the lock
+	var q = openQueue()
+	if cmd.Active.Name != "dump" {
+		var unlock, err = q.Lock()
+		if err != nil {
+			log.Fatalf("Unable to modify queue: %s", err)
+		}
+		defer unlock()
+	}
+
+	var args = map[string]queueIDArgs{
+		"flush":   opts.Queue.Flush,
+		"delete":  opts.Queue.Delete,
+		"hold":    opts.Queue.Hold,
+		"release": opts.Queue.Release,
+		"dump":    opts.Queue.Dump,
+	}
+	var en, err = q.Entry(args[cmd.Active.Name].Args.ID)
+	if err != nil {
+		log.Fatalf("Unable to read queue entry: %s", err)
+	}
+
+	switch cmd.Active.Name {
+	case "flush":
+		if en.Held {
+			log.Fatalf("Queued message %s is held; release it first", en.ID)
+		}
+		retry(q, loadRules(), en)
+	case "delete":
+		err = q.Remove(en)
+	case "hold":
+		err = q.Hold(en)
+	case "release":
+		err = q.Release(en)
+	case "dump":
+		var data []byte
+		data, err = q.Raw(en)
+		if err == nil {
+			_, err = os.Stdout.Write(data)
+		}
+	}
+
+	if err != nil {
+		log.Fatalf("Unable to %s queued message %s: %s", cmd.Active.Name, en.ID, err)
+	}
+}
+
+// listQueue prints the queue in a format similar to sendmail's mailq.  Held
+// entries have a "!" after their ID.
+func listQueue() {
+	var q = openQueue()
+	var list, err = q.Entries()
+	if err != nil {
+		log.Fatalf("Unable to read queue %q: %s", q.Dir, err)
+	}
+	if len(list) == 0 {
+		fmt.Println("Mail queue is empty")
+		return
+	}
+
+	var total int
+	fmt.Printf("%-22s %8s %6s  %s\n", "Queue ID", "Size", "Age", "Sender/Recipients")
+	for _, en := range list {
+		var id = en.ID
+		if en.Held {
+			id += "!"
+		}
+		fmt.Printf("%-22s %8d %6s  %s\n", id, en.Size, formatAge(time.Since(en.Created)), en.Sender)
+		if en.LastError != "" {
+			fmt.Printf("%40s(%s)\n", "", en.LastError)
+		}
+		for _, rcpt := range en.Recipients {
+			fmt.Printf("%40s%s\n", "", rcpt)
+		}
+		total += en.Size
+	}
+	fmt.Printf("-- %d bytes in %d requests.\n", total, len(list))
+}
+
+// formatAge returns a short, human-friendly age like "45s", "12m", "3h", or
+// "2d"
+func formatAge(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	}
+	return fmt.Sprintf("%dd", int(d.Hours()/24))
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Nerdmaster/sendmail/email"
+	"github.com/Nerdmaster/sendmail/queue"
+	flags "github.com/jessevdk/go-flags"
+	"github.com/uoregon-libraries/gopkg/assert"
+)
+
+func TestEnqueueFailureIsTemporary(t *testing.T) {
+	var rules = mkrules(t, "- matchers: [\"*\"]\n  auth: {server: \"127.0.0.1:1\", mechanism: none, tls: none}\n")
+	var dir = mkconfig(t, map[string]string{"file": ""})
+	var oldDir = opts.QueueDir
+	defer func() { opts.QueueDir = oldDir }()
+
+	// A queue under a regular file can't be created, even by root
+	opts.QueueDir = filepath.Join(dir, "file", "queue")
+	var sendErr = &textproto.Error{Code: 451, Msg: "try again later"}
+	var err = enqueue(rules, ruleMatch{index: 0}, mkemail(t, "a@example.org"), sendErr)
+	assert.True(err != nil, "enqueue fails without a queue", t)
+	assert.True(strings.Contains(err.Error(), "unable to open queue"), "error: "+err.Error(), t)
+	assert.True(email.IsTemporary(err), "a temporary failure stays temporary when it can't be queued", t)
+}
+
+// mkspool points opts.QueueDir at a new temp dir for the rest of the test,
+// and returns the queue there
+func mkspool(t *testing.T) *queue.Queue {
+	var saved = opts
+	t.Cleanup(func() { opts = saved })
+	opts.QueueDir = mkconfig(t, nil)
+	opts.QueueLifetime = time.Hour
+
+	var q, err = queue.Open(opts.QueueDir)
+	if err != nil {
+		t.Fatalf("Unable to open queue: %s", err)
+	}
+	return q
+}
+
+// queueEmail adds a message to rcpt to q, as if the rule with the given ID
+// had failed to send it
+func queueEmail(t *testing.T, q *queue.Queue, rcpt, ruleID string) *queue.Entry {
+	var en, err = q.Add(mkemail(t, rcpt), ruleID, nil, &textproto.Error{Code: 451, Msg: "try again later"})
+	if err != nil {
+		t.Fatalf("Unable to queue message: %s", err)
+	}
+	en.NextAttempt = time.Now()
+	err = q.Update(en)
+	if err != nil {
+		t.Fatalf("Unable to update queue entry: %s", err)
+	}
+	return en
+}
+
+// queueRules returns a rule for each of the fake servers, named after it
+func queueRules(t *testing.T, servers map[string]*fakeServer) []*RuleConf {
+	var data string
+	for name, fs := range servers {
+		data += fmt.Sprintf("- name: %s\n  matchers: [\"*\"]\n  auth: {server: %q, mechanism: none, tls: none}\n", name, fs.addr)
+	}
+	return mkrules(t, data)
+}
+
+func TestFlushQueue(t *testing.T) {
+	var ok, perm, temp = newFakeServer(t), newFakeServer(t), newFakeServer(t)
+	perm.reply = 550
+	temp.reply = 451
+	var rules = queueRules(t, map[string]*fakeServer{"ok": ok, "perm": perm, "temp": temp})
+	var q = mkspool(t)
+
+	var delivered = queueEmail(t, q, "a@example.org", "ok")
+	var rejected = queueEmail(t, q, "b@example.org", "perm")
+	var deferred = queueEmail(t, q, "c@example.org", "temp")
+	var orphan = queueEmail(t, q, "d@example.org", "gone")
+	var notDue = queueEmail(t, q, "e@example.org", "ok")
+	notDue.NextAttempt = time.Now().Add(time.Hour)
+	q.Update(notDue)
+	var expired = queueEmail(t, q, "f@example.org", "temp")
+	expired.Created = time.Now().Add(-2 * time.Hour)
+	q.Update(expired)
+
+	flushQueue(q, rules)
+	assert.Equal("a@example.org", ok.recipients(), "delivered recipients", t)
+
+	var _, err = q.Entry(delivered.ID)
+	assert.True(err != nil, "a delivered entry is removed", t)
+	_, err = q.Entry(rejected.ID)
+	assert.True(err != nil, "an entry with a permanent failure is removed", t)
+	_, err = q.Entry(expired.ID)
+	assert.True(err != nil, "an entry older than the queue lifetime is removed", t)
+
+	var en *queue.Entry
+	en, err = q.Entry(deferred.ID)
+	assert.NilError(err, "an entry with a temporary failure stays queued", t)
+	assert.Equal(2, en.Attempts, "the failed attempt is counted", t)
+	assert.True(strings.Contains(en.LastError, "fake reply"), "last error: "+en.LastError, t)
+	assert.True(en.NextAttempt.After(time.Now()), "the next attempt is rescheduled", t)
+
+	en, err = q.Entry(orphan.ID)
+	assert.NilError(err, "an entry whose rule is gone stays queued", t)
+	assert.True(en.Held, "an entry whose rule is gone is held", t)
+
+	en, err = q.Entry(notDue.ID)
+	assert.NilError(err, "an entry which isn't due stays queued", t)
+	assert.Equal(1, en.Attempts, "an entry which isn't due isn't retried", t)
+}
+
+func TestFlushQueueFindsRuleByID(t *testing.T) {
+	var first, second = newFakeServer(t), newFakeServer(t)
+	var q = mkspool(t)
+	queueEmail(t, q, "a@example.org", "second")
+
+	// Both rules match, but the entry only goes through the one which queued it
+	var rules = mkrules(t, fmt.Sprintf(""+
+		"- name: first\n  matchers: [\"*\"]\n  auth: {server: %q, mechanism: none, tls: none}\n"+
+		"- name: second\n  matchers: [\"*\"]\n  auth: {server: %q, mechanism: none, tls: none}\n",
+		first.addr, second.addr))
+	flushQueue(q, rules)
+	assert.Equal("", first.recipients(), "nothing is sent through another rule", t)
+	assert.Equal("a@example.org", second.recipients(), "the entry is sent through its own rule", t)
+}
+
+// runQueueArgs parses argv as the command line, which must run a queue
+// subcommand against q, and returns what the subcommand writes to stdout
+func runQueueArgs(t *testing.T, q *queue.Queue, argv ...string) string {
+	var parser = flags.NewParser(&opts, flags.None)
+	parser.SubcommandsOptional = true
+	var _, err = parser.ParseArgs(append([]string{"--queue-dir", q.Dir}, argv...))
+	if err != nil {
+		t.Fatalf("Unable to parse %q: %s", argv, err)
+	}
+	return captureStdout(t, func() { runQueueCommand(parser.Active) })
+}
+
+func TestQueueHoldRelease(t *testing.T) {
+	var q = mkspool(t)
+	var en = queueEmail(t, q, "a@example.org", "ok")
+
+	runQueueArgs(t, q, "queue", "hold", en.ID)
+	var held, err = q.Entry(en.ID)
+	assert.NilError(err, "held entry is still queued", t)
+	assert.True(held.Held, "entry is held", t)
+
+	runQueueArgs(t, q, "queue", "release", en.ID)
+	var released *queue.Entry
+	released, err = q.Entry(en.ID)
+	assert.NilError(err, "released entry is still queued", t)
+	assert.False(released.Held, "entry is released", t)
+	assert.False(released.NextAttempt.After(time.Now()), "released entry is due right away", t)
+}
+
+func TestQueueDelete(t *testing.T) {
+	var q = mkspool(t)
+	var en = queueEmail(t, q, "a@example.org", "ok")
+	var other = queueEmail(t, q, "b@example.org", "ok")
+
+	runQueueArgs(t, q, "queue", "delete", en.ID)
+	var _, err = q.Entry(en.ID)
+	assert.True(err != nil, "deleted entry is gone", t)
+	_, err = q.Entry(other.ID)
+	assert.NilError(err, "other entry is still queued", t)
+}
+
+func TestQueueDump(t *testing.T) {
+	var q = mkspool(t)
+	var en = queueEmail(t, q, "a@example.org", "ok")
+	var data, err = q.Raw(en)
+	assert.NilError(err, "reading the queued message", t)
+
+	var out = runQueueArgs(t, q, "queue", "dump", en.ID)
+	assert.Equal(string(data), out, "dump writes the message as spooled", t)
+	assert.True(strings.Contains(out, "To: a@example.org"), "dumped message: "+out, t)
+}
+
+func TestQueueFlush(t *testing.T) {
+	var fs = newFakeServer(t)
+	var dir = mkconfig(t, map[string]string{
+		"c.yml": fmt.Sprintf("- name: ok\n  matchers: [\"*\"]\n  auth: {server: %q, mechanism: none, tls: none}\n", fs.addr),
+	})
+	var q = mkspool(t)
+	var en = queueEmail(t, q, "a@example.org", "ok")
+	en.NextAttempt = time.Now().Add(time.Hour)
+	q.Update(en)
+
+	runQueueArgs(t, q, "-C", filepath.Join(dir, "c.yml"), "queue", "flush", en.ID)
+	assert.Equal("a@example.org", fs.recipients(), "flush retries an entry which isn't due yet", t)
+	var _, err = q.Entry(en.ID)
+	assert.True(err != nil, "delivered entry is removed", t)
+}
+
+func TestListQueue(t *testing.T) {
+	var q = mkspool(t)
+	var out = runQueueArgs(t, q, "queue", "list")
+	assert.Equal("Mail queue is empty\n", out, "empty queue", t)
+
+	var en = queueEmail(t, q, "a@example.org", "ok")
+	var held = queueEmail(t, q, "b@example.org, c@example.org", "ok")
+	q.Hold(held)
+
+	var lines = strings.Split(strings.TrimSuffix(runQueueArgs(t, q, "queue", "list"), "\n"), "\n")
+	var want = []string{
+		fmt.Sprintf("%-22s %8s %6s  %s", "Queue ID", "Size", "Age", "Sender/Recipients"),
+		fmt.Sprintf("%-22s %8d %6s  %s", en.ID, en.Size, "0s", "me@example.com"),
+		strings.Repeat(" ", 40) + `(451 "try again later")`,
+		strings.Repeat(" ", 40) + "a@example.org",
+		fmt.Sprintf("%-22s %8d %6s  %s", held.ID+"!", held.Size, "0s", "me@example.com"),
+		strings.Repeat(" ", 40) + `(451 "try again later")`,
+		strings.Repeat(" ", 40) + "b@example.org",
+		strings.Repeat(" ", 40) + "c@example.org",
+		fmt.Sprintf("-- %d bytes in 2 requests.", en.Size+held.Size),
+	}
+	assert.Equal(strings.Join(want, "\n"), strings.Join(lines, "\n"), "queue listing", t)
+}